@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// gori doesn't do its own logins. it expects to sit behind something
+// (an SSO proxy, basic auth in nginx, etc) that sets a header with the
+// username. admins are just a list of those usernames from the config.
+// with no header configured, nobody is logged in and nobody is an admin,
+// since otherwise any client could just send the header itself.
+
+type Auth struct {
+	userHeader string
+	admins     map[string]bool
+}
+
+func NewAuth(userHeader, admins string) *Auth {
+	a := &Auth{userHeader: userHeader, admins: make(map[string]bool)}
+	for _, admin := range strings.Split(admins, ",") {
+		admin = strings.TrimSpace(admin)
+		if admin != "" {
+			a.admins[admin] = true
+		}
+	}
+	return a
+}
+
+func (a Auth) User(r *http.Request) string {
+	if a.userHeader == "" {
+		return ""
+	}
+	return strings.TrimSpace(r.Header.Get(a.userHeader))
+}
+
+func (a Auth) IsAdmin(r *http.Request) bool {
+	user := a.User(r)
+	if user == "" {
+		return false
+	}
+	return a.admins[user]
+}
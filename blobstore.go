@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// attachment contents are stored by the sha256 of their contents, so
+// uploading the same file twice (or to two pages) only stores it once
+// and the events just need to remember the hash.
+
+type BlobStore interface {
+	Put(io.Reader) (string, int64, error)
+	Open(string) (io.ReadSeekCloser, error)
+}
+
+var errBadHash = errors.New("not a valid blob hash")
+
+// LocalBlobStore keeps blobs in a directory on disk, spread out over
+// subdirectories named for the first two characters of the hash
+type LocalBlobStore struct {
+	dir string
+}
+
+func NewLocalBlobStore(dir string) (*LocalBlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &LocalBlobStore{dir: dir}, nil
+}
+
+func validHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+func (s LocalBlobStore) path(hash string) string {
+	return filepath.Join(s.dir, hash[:2], hash)
+}
+
+func (s *LocalBlobStore) Put(r io.Reader) (string, int64, error) {
+	// write to a temp file while hashing, then move it into place
+	tmp, err := ioutil.TempFile(s.dir, "upload-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	tmp.Close()
+	if err != nil {
+		return "", 0, err
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+	path := s.path(hash)
+	if _, err := os.Stat(path); err == nil {
+		// already have it
+		return hash, size, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", 0, err
+	}
+	return hash, size, os.Rename(tmp.Name(), path)
+}
+
+func (s *LocalBlobStore) Open(hash string) (io.ReadSeekCloser, error) {
+	if !validHash(hash) {
+		return nil, errBadHash
+	}
+	return os.Open(s.path(hash))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+)
+
+// CSRF tokens are tied to a random per-browser session cookie. the token
+// itself is an HMAC of the session id, so nothing needs to be stored on
+// the server side. if no secret is configured, a random one is made at
+// startup, which means forms opened before a restart will need a reload.
+
+const (
+	sessionCookieName = "gori_session"
+	csrfFieldName     = "csrf_token"
+)
+
+// what every form that changes something says when its token is no good
+const csrfFailedMessage = "invalid or missing CSRF token. reload the form and try again"
+
+type CSRF struct {
+	secret []byte
+	secure bool
+}
+
+func NewCSRF(secret string, secure bool) *CSRF {
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			log.Fatal("can't generate CSRF secret: ", err)
+		}
+	}
+	return &CSRF{secret: key, secure: secure}
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Println(err)
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+func (c CSRF) tokenFor(sessionID string) string {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(sessionID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Token returns the CSRF token for the request's session, starting a new
+// session (and setting the cookie) if there isn't one yet. it has to be
+// called before anything is written to the response body.
+func (c CSRF) Token(w http.ResponseWriter, r *http.Request) string {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err == nil && cookie.Value != "" {
+		return c.tokenFor(cookie.Value)
+	}
+	sessionID := randomToken()
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    sessionID,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   c.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return c.tokenFor(sessionID)
+}
+
+// Verify checks the token posted with a form against the session cookie.
+func (c CSRF) Verify(r *http.Request) bool {
+	return c.VerifyToken(r, r.FormValue(csrfFieldName))
+}
+
+// VerifyToken checks a token from somewhere other than the form body
+// against the session cookie. it doesn't touch the body, so it can be
+// done before reading a big upload.
+func (c CSRF) VerifyToken(r *http.Request, token string) bool {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	if token == "" {
+		return false
+	}
+	return hmac.Equal([]byte(token), []byte(c.tokenFor(cookie.Value)))
+}
@@ -3,19 +3,46 @@ package main
 import (
 	"encoding/json"
 	"html/template"
+	"mime"
+	"net/url"
+	"path"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
-
-	"github.com/russross/blackfriday"
 )
 
 type Page struct {
-	Slug     string    `json:"slug"`
-	Title    string    `json:"title"`
-	Body     string    `json:"body"`
-	Created  time.Time `json:"created"`
-	Modified time.Time `json:"modified"`
+	Slug        string       `json:"slug"`
+	Title       string       `json:"title"`
+	Body        string       `json:"body"`
+	Created     time.Time    `json:"created"`
+	Modified    time.Time    `json:"modified"`
+	Protected   bool         `json:"protected"`
+	Tags        []string     `json:"tags"`
+	Meta        PageMeta     `json:"meta"`
+	RedirectTo  string       `json:"redirect_to,omitempty"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// how many events have been applied to get the page to this state
+	Version int `json:"version"`
+}
+
+type Attachment struct {
+	Name        string    `json:"name"`
+	Hash        string    `json:"hash"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	Created     time.Time `json:"created"`
+}
+
+func (a Attachment) IsImage() bool {
+	return strings.HasPrefix(a.ContentType, "image/")
+}
+
+// Exists is whether there's actually a page here, rather than nothing
+// or a redirect to somewhere else
+func (p Page) Exists() bool {
+	return p.Title != "" && p.RedirectTo == ""
 }
 
 func (p *Page) SetTitle(title string) bool {
@@ -37,48 +64,235 @@ func (p *Page) SetBody(body string) bool {
 		return false
 	}
 	p.Body = body
+	p.Meta = metaFor(body)
+	return true
+}
+
+// normalizeTags lowercases, trims and dedupes tags, keeping their order
+func normalizeTags(tags []string) []string {
+	normalized := make([]string, 0, len(tags))
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	return normalized
+}
+
+func (p *Page) SetTags(tags []string) bool {
+	tags = normalizeTags(tags)
+	if strings.Join(tags, ",") == strings.Join(p.Tags, ",") {
+		return false
+	}
+	p.Tags = tags
+	return true
+}
+
+// AllTags is the tags set on the page plus any from its front matter
+func (p Page) AllTags() []string {
+	return normalizeTags(append(append([]string{}, p.Tags...), p.Meta.Tags...))
+}
+
+// Attach adds an attachment, replacing any existing one with the same
+// name. it makes a new slice rather than changing the old one in place,
+// since copies of the page (like the one in the index) share it.
+func (p *Page) Attach(a Attachment) bool {
+	if a.Name == "" || a.Hash == "" {
+		return false
+	}
+	attachments := make([]Attachment, 0, len(p.Attachments)+1)
+	replaced := false
+	for _, existing := range p.Attachments {
+		if existing.Name != a.Name {
+			attachments = append(attachments, existing)
+			continue
+		}
+		if existing.Hash == a.Hash {
+			return false
+		}
+		attachments = append(attachments, a)
+		replaced = true
+	}
+	if !replaced {
+		attachments = append(attachments, a)
+	}
+	p.Attachments = attachments
+	return true
+}
+
+func (p Page) Attachment(name string) (Attachment, bool) {
+	for _, a := range p.Attachments {
+		if a.Name == name {
+			return a, true
+		}
+	}
+	return Attachment{}, false
+}
+
+func (p *Page) SetProtected(protected bool) bool {
+	if protected == p.Protected {
+		return false
+	}
+	p.Protected = protected
 	return true
 }
 
 func (p Page) RenderedBody() template.HTML {
-	return template.HTML(string(blackfriday.MarkdownCommon([]byte(p.LinkText()))))
+	renderer := renderers.Get(p.Meta.Renderer)
+	html := renderer.Render([]byte(p.LinkText()))
+	return template.HTML(string(insertTOC(sanitizer.Sanitize(html))))
 }
 
 func (p Page) RenderModified() string {
 	return p.Modified.Format(time.RFC3339)
 }
 
-func makeLink(s string) string {
+func makeLink(s, base string) string {
 	// s should look like '[[Page Title]]'
 	// or [[Page Title|link text]]
 	// we turn those into
 	// [Page Title](/page/page-title/)
 	// or
 	// [link text](/page/page-title/)
-	// respectively
+	// respectively. titles can be paths like [[team/oncall]], or
+	// relative to base, the page the link is on, like [[./runbook]]
+	if isTOCMarker(s) {
+		// not a link, it gets swapped for the table of contents later
+		return tocMarker
+	}
 	s = strings.Trim(s, "[]- ") // get rid of the delimiters
+	if isFileLink(s) {
+		return fileLink(s, base)
+	}
 	title := s
-	link := "/page/" + slugify(s) + "/"
+	link := "/page/" + linkTarget(s, base) + "/"
 	if strings.Index(s, "|") != -1 {
 		parts := strings.SplitN(s, "|", 2)
 		page_title := strings.Trim(parts[0], " ")
 		link_text := strings.Trim(parts[1], " ")
 		title = link_text
-		link = "/page/" + slugify(page_title) + "/"
+		link = "/page/" + linkTarget(page_title, base) + "/"
 	}
 	return "[" + title + "](" + link + ")"
 }
 
+const fileLinkPrefix = "file:"
+
+func isFileLink(s string) bool {
+	return len(s) > len(fileLinkPrefix) &&
+		strings.EqualFold(s[:len(fileLinkPrefix)], fileLinkPrefix)
+}
+
+var imageSizePattern = regexp.MustCompile(`^(\d*)(?:x(\d+))?px$`)
+
+// fileLink handles [[File:name.png]] or [[File:name.pdf|description]],
+// an attachment on the page the link is on. images are embedded,
+// anything else is a link to download it. images can also be given a
+// size to fit in, like [[File:name.png|300px]] or
+// [[File:name.png|300x200px|description]], which shows a thumbnail that
+// links to the full image.
+func fileLink(s, base string) string {
+	parts := strings.Split(strings.TrimSpace(s[len(fileLinkPrefix):]), "|")
+	name := strings.TrimSpace(parts[0])
+	text := name
+	size := url.Values{}
+	for _, part := range parts[1:] {
+		part = strings.TrimSpace(part)
+		m := imageSizePattern.FindStringSubmatch(part)
+		if m != nil && (m[1] != "" || m[2] != "") {
+			if m[1] != "" {
+				size.Set("w", clampImageSize(m[1]))
+			}
+			if m[2] != "" {
+				size.Set("h", clampImageSize(m[2]))
+			}
+		} else if part != "" {
+			text = part
+		}
+	}
+	link := attachmentURL(base, name)
+	if !isImageName(name) {
+		return "[" + text + "](" + link + ")"
+	}
+	if len(size) > 0 {
+		return "[![" + text + "](" + link + "?" + size.Encode() + ")](" + link + ")"
+	}
+	return "![" + text + "](" + link + ")"
+}
+
+// clampImageSize keeps a size from the page within what the thumbnailer
+// will make, so [[File:x.png|3000px]] shows the biggest thumbnail there
+// is instead of a broken image
+func clampImageSize(n string) string {
+	if size, err := strconv.Atoi(n); err != nil || size > maxThumbnailSize {
+		return strconv.Itoa(maxThumbnailSize)
+	}
+	return n
+}
+
+func attachmentURL(slug, name string) string {
+	return "/attachments/" + slug + "/" + url.PathEscape(name)
+}
+
+func isImageName(name string) bool {
+	return strings.HasPrefix(mime.TypeByExtension(path.Ext(name)), "image/")
+}
+
 func (p Page) LinkText() string {
 	pattern, _ := regexp.Compile(`(\[\[\s*[^\|\]]+\s*\|?\s*[^\]]*\s*\]\])`)
-	return pattern.ReplaceAllStringFunc(p.Body, makeLink)
+	return pattern.ReplaceAllStringFunc(p.Content(), func(s string) string {
+		return makeLink(s, p.Slug)
+	})
+}
+
+// canonicalSlug maps a slug to the page it should really link to,
+// following aliases and redirects. main() hooks it up to the page index.
+var canonicalSlug = func(slug string) string {
+	return slug
 }
 
-func slugify(s string) string {
-	s = strings.Trim(s, " \t\n\r-")
-	s = strings.Replace(s, " ", "-", -1)
-	s = strings.ToLower(s)
-	return s
+func linkTarget(target, base string) string {
+	return canonicalSlug(resolveLink(target, base))
+}
+
+// resolveLink turns a link target into a slug. targets starting with
+// ./ or ../ are relative to the namespace base is in, the way relative
+// paths work for files in a directory: from team/oncall, ./runbook is
+// team/runbook and ../faq is faq. anything else is from the top.
+func resolveLink(target, base string) string {
+	target = strings.TrimSpace(target)
+	if !strings.HasPrefix(target, "./") && !strings.HasPrefix(target, "../") {
+		return slugify(target)
+	}
+	segments := strings.Split(base, "/")
+	segments = segments[:len(segments)-1]
+	for _, segment := range strings.Split(target, "/") {
+		switch strings.TrimSpace(segment) {
+		case ".", "":
+		case "..":
+			if len(segments) > 0 {
+				segments = segments[:len(segments)-1]
+			}
+		default:
+			segments = append(segments, segment)
+		}
+	}
+	return slugify(strings.Join(segments, "/"))
+}
+
+// parentSlugs returns the slugs of the namespaces a page is in, from
+// the top down, so team/oncall/runbook gives team, team/oncall
+func parentSlugs(slug string) []string {
+	parents := make([]string, 0)
+	segments := strings.Split(slug, "/")
+	for i := 1; i < len(segments); i++ {
+		parents = append(parents, strings.Join(segments[:i], "/"))
+	}
+	return parents
 }
 
 func (p Page) JSON() string {
@@ -93,4 +307,12 @@ type PageReadRepository interface {
 type PageWriteRepository interface {
 	SetTitle(*Page, string) error
 	SetBody(*Page, string) error
+	SetTags(*Page, []string) error
+	// Save sets the title, body and tags all at once, as long as
+	// nobody has saved the page since it was read. if they have, it
+	// gives back errVersionConflict and nothing is saved.
+	Save(page *Page, title, body string, tags []string) error
+	Attach(*Page, Attachment, string) error
+	Protect(*Page, string) error
+	Unprotect(*Page, string) error
 }
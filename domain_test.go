@@ -1,8 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"html/template"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestSetTitle(t *testing.T) {
@@ -40,6 +57,84 @@ func TestSetBody(t *testing.T) {
 	}
 }
 
+func TestSetProtected(t *testing.T) {
+	p := Page{}
+	if p.SetProtected(false) {
+		t.Error("new pages start out unprotected")
+	}
+	if !p.SetProtected(true) {
+		t.Error("should be able to protect a page")
+	}
+	if !p.Protected {
+		t.Error("didn't set it")
+	}
+	if p.SetProtected(true) {
+		t.Error("protecting a protected page should do nothing")
+	}
+}
+
+func TestAuthHeader(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Remote-User", "alice")
+	if a := NewAuth("", "alice"); a.User(r) != "" || a.IsAdmin(r) {
+		t.Error("without a user_header configured, the header should be ignored")
+	}
+	if a := NewAuth("X-Remote-User", "alice"); a.User(r) != "alice" || !a.IsAdmin(r) {
+		t.Error("should trust the configured header")
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	csrf := NewCSRF("secret", false)
+
+	// a round trip: the form gets a token and a new session cookie
+	w := httptest.NewRecorder()
+	token := csrf.Token(w, httptest.NewRequest("GET", "/edit/x/", nil))
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookieName || !cookies[0].HttpOnly {
+		t.Fatal(fmt.Sprintf("should've started a session %v", cookies))
+	}
+	session := cookies[0].Value
+
+	// asking again in the same session gives the same token, no new cookie
+	r := httptest.NewRequest("GET", "/edit/x/", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: session})
+	w = httptest.NewRecorder()
+	if again := csrf.Token(w, r); again != token || len(w.Result().Cookies()) != 0 {
+		t.Error("the token should stay the same for the session")
+	}
+
+	other := csrf.tokenFor("another session")
+	for _, c := range []struct {
+		name    string
+		csrf    *CSRF
+		session string
+		token   string
+		valid   bool
+	}{
+		{"valid round trip", csrf, session, token, true},
+		{"missing cookie", csrf, "", token, false},
+		{"missing token", csrf, session, "", false},
+		{"wrong token", csrf, session, "0123456789abcdef", false},
+		{"token from another session", csrf, session, other, false},
+		{"secret rotated", NewCSRF("new secret", false), session, token, false},
+		{"random secret", NewCSRF("", false), session, token, false},
+	} {
+		form := url.Values{}
+		if c.token != "" {
+			form.Set(csrfFieldName, c.token)
+		}
+		r := httptest.NewRequest("POST", "/edit/x/", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if c.session != "" {
+			r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: c.session})
+		}
+		if c.csrf.Verify(r) != c.valid {
+			t.Error(fmt.Sprintf("%s: expected valid to be %v", c.name, c.valid))
+		}
+	}
+}
+
 func TestLinkText(t *testing.T) {
 	p := Page{}
 	p.SetBody("no links")
@@ -66,3 +161,1499 @@ func TestLinkText(t *testing.T) {
 		t.Error(fmt.Sprintf("didn't handle simple link %s", p.LinkText()))
 	}
 }
+
+func TestRenderedBodySanitized(t *testing.T) {
+	p := Page{}
+	p.SetBody("hello <script>alert('hi')</script> [x](javascript:alert(1))")
+	out := string(p.RenderedBody())
+	if strings.Contains(out, "<script") {
+		t.Error(fmt.Sprintf("script tag should've been stripped %s", out))
+	}
+	if strings.Contains(out, "javascript:") {
+		t.Error(fmt.Sprintf("javascript: link should've been stripped %s", out))
+	}
+	if !strings.Contains(out, "hello") {
+		t.Error(fmt.Sprintf("lost the actual content %s", out))
+	}
+
+	old := sanitizer
+	defer func() { sanitizer = old }()
+	sanitizer = NewSanitizer(defaultAllowedTags, defaultAllowedAttributes, defaultURLSchemes, true)
+	out = string(p.RenderedBody())
+	if !strings.Contains(out, "<script") {
+		t.Error(fmt.Sprintf("trusted mode shouldn't sanitize %s", out))
+	}
+}
+
+func TestAlignedTable(t *testing.T) {
+	p := Page{Body: "| left | right | centre |\n|:--|--:|:-:|\n| a | b | c |\n"}
+	out := string(p.RenderedBody())
+	for _, expected := range []string{`<th align="left">left</th>`, `<th align="right">right</th>`, `<td align="center">c</td>`} {
+		if !strings.Contains(out, expected) {
+			t.Error(fmt.Sprintf("column alignment should survive sanitizing, expected %s in %s", expected, out))
+		}
+	}
+}
+
+func TestRenderedBodyGFM(t *testing.T) {
+	p := Page{}
+	p.SetBody("| a | b |\n|---|---|\n| 1 | 2 |\n\n~~gone~~\n\n- [x] done\n")
+	out := string(p.RenderedBody())
+	if !strings.Contains(out, "<table>") {
+		t.Error(fmt.Sprintf("tables should be rendered %s", out))
+	}
+	if !strings.Contains(out, "<del>gone</del>") {
+		t.Error(fmt.Sprintf("strikethrough should be rendered %s", out))
+	}
+	if !strings.Contains(out, "checkbox") {
+		t.Error(fmt.Sprintf("task lists should be rendered %s", out))
+	}
+}
+
+func TestFrontMatterRenderer(t *testing.T) {
+	p := Page{}
+	p.SetBody("---\nrenderer: blackfriday\n---\n- [x] done\n")
+	if p.Meta.Renderer != "blackfriday" {
+		t.Error("didn't parse the front matter")
+	}
+	if p.Content() != "- [x] done\n" {
+		t.Error(fmt.Sprintf("front matter should be stripped from the content %q", p.Content()))
+	}
+	out := string(p.RenderedBody())
+	if strings.Contains(out, "renderer") {
+		t.Error(fmt.Sprintf("front matter shouldn't be rendered %s", out))
+	}
+	if strings.Contains(out, "checkbox") {
+		t.Error(fmt.Sprintf("blackfriday doesn't do task lists %s", out))
+	}
+}
+
+func TestTOC(t *testing.T) {
+	p := Page{}
+	p.SetBody("[[toc]]\n\n# One\n\n## Sub Section\n\n# Two {#second}\n")
+	out := string(p.RenderedBody())
+	if strings.Contains(out, "[[toc]]") || strings.Contains(out, "/page/toc/") {
+		t.Error(fmt.Sprintf("toc marker should've been replaced %s", out))
+	}
+	if !strings.Contains(out, `<a href="#sub-section">Sub Section</a>`) {
+		t.Error(fmt.Sprintf("missing toc entry for the subsection %s", out))
+	}
+	if !strings.Contains(out, `<a href="#second">Two</a>`) {
+		t.Error(fmt.Sprintf("should use explicit heading ids %s", out))
+	}
+
+	entries := extractTOC([]byte(out))
+	if len(entries) != 3 {
+		t.Error(fmt.Sprintf("expected three headings, got %d", len(entries)))
+	}
+	if renderTOC(nil) != "" {
+		t.Error("no headings, no toc")
+	}
+}
+
+func TestHighlighting(t *testing.T) {
+	p := Page{}
+	p.SetBody("```go\nfunc main() {}\n```\n")
+	out := string(p.RenderedBody())
+	if !strings.Contains(out, `class="chroma"`) {
+		t.Error(fmt.Sprintf("code block should be highlighted %s", out))
+	}
+	if strings.Contains(out, "style=") {
+		t.Error(fmt.Sprintf("highlighting should only use classes %s", out))
+	}
+}
+
+func TestTransclusion(t *testing.T) {
+	index := NewPageIndex()
+	index.Update(Page{Slug: "outer", Title: "Outer", Body: "before\n\n{{include: Inner Page}}\n\nafter"})
+	index.Update(Page{Slug: "inner-page", Title: "Inner Page", Body: "*inside*\n\n{{include: Outer}}\n"})
+
+	outer, _ := index.FindBySlug("outer")
+	if len(outer.Includes()) != 1 || outer.Includes()[0] != "inner-page" {
+		t.Error(fmt.Sprintf("wrong includes %v", outer.Includes()))
+	}
+	by := index.IncludedBy("inner-page")
+	if len(by) != 1 || by[0] != "outer" {
+		t.Error(fmt.Sprintf("wrong included by %v", by))
+	}
+
+	// the included by list follows edits, and aliases added after the
+	// including page was saved
+	index.Update(Page{Slug: "other", Title: "Other", Body: "{{include: inner}}"})
+	if by := index.IncludedBy("inner-page"); len(by) != 1 {
+		t.Error(fmt.Sprintf("inner isn't an alias yet %v", by))
+	}
+	inner, _ := index.FindBySlug("inner-page")
+	inner.SetBody("---\naliases: [inner]\n---\n*inside*\n\n{{include: Outer}}\n")
+	index.Update(*inner)
+	if by := index.IncludedBy("inner-page"); len(by) != 2 || by[1] != "outer" {
+		t.Error(fmt.Sprintf("should include through the alias %v", by))
+	}
+	index.Update(Page{Slug: "other", Title: "Other", Body: "nothing"})
+	if by := index.IncludedBy("inner-page"); len(by) != 1 {
+		t.Error(fmt.Sprintf("other doesn't include it any more %v", by))
+	}
+
+	out := string(NewTranscluder(index, defaultMaxIncludeDepth).Render(outer))
+	if !strings.Contains(out, `<div class="include" data-page="inner-page"><p><em>inside</em></p>`) {
+		t.Error(fmt.Sprintf("didn't include the inner page %s", out))
+	}
+	if !strings.Contains(out, "recursive include of") {
+		t.Error(fmt.Sprintf("should've caught the recursion %s", out))
+	}
+
+	// including a page that redirects back is still recursion
+	index.Update(Page{Slug: "there", Title: "There", Body: "{{include: back}}"})
+	index.Update(Page{Slug: "back", RedirectTo: "there"})
+	there, _ := index.FindBySlug("there")
+	out = string(NewTranscluder(index, defaultMaxIncludeDepth).Render(there))
+	if !strings.Contains(out, "recursive include of") || strings.Contains(out, "nested too deeply") {
+		t.Error(fmt.Sprintf("should've caught the recursion through the redirect %s", out))
+	}
+
+	index.Update(Page{Slug: "lonely", Title: "Lonely", Body: "{{include: Nobody}}"})
+	lonely, _ := index.FindBySlug("lonely")
+	out = string(NewTranscluder(index, defaultMaxIncludeDepth).Render(lonely))
+	if !strings.Contains(out, "no page called") {
+		t.Error(fmt.Sprintf("should say the page is missing %s", out))
+	}
+}
+
+func TestApplyTemplate(t *testing.T) {
+	now := time.Date(2014, 3, 9, 14, 30, 0, 0, time.UTC)
+	vars := templateVars("Standup", "standup", "anders", now)
+	out := applyTemplate("# {{title}} {{ date }}\nby {{author}}\n{{include: Agenda}} {{nope}}", vars)
+	expected := "# Standup 2014-03-09\nby anders\n{{include: Agenda}} {{nope}}"
+	if out != expected {
+		t.Error(fmt.Sprintf("bad substitution %q", out))
+	}
+
+	index := NewPageIndex()
+	index.Update(Page{Slug: "template:runbook", Title: "Template:Runbook", Body: "x"})
+	index.Update(Page{Slug: "runbook", Title: "Runbook", Body: "x"})
+	templates := index.Templates()
+	if len(templates) != 1 || templates[0].Slug != "template:runbook" {
+		t.Error(fmt.Sprintf("wrong templates %v", templates))
+	}
+}
+
+func TestFrontMatterMeta(t *testing.T) {
+	p := Page{Title: "Oncall"}
+	p.SetBody("---\ntags: [ops, oncall]\naliases: pager, on-call\nauthor: anders\nteam: infra\n---\nbody")
+	if len(p.Meta.Tags) != 2 || p.Meta.Tags[1] != "oncall" {
+		t.Error(fmt.Sprintf("wrong tags %v", p.Meta.Tags))
+	}
+	if len(p.Meta.Aliases) != 2 || p.Meta.Aliases[1] != "on-call" {
+		t.Error(fmt.Sprintf("comma separated aliases should work %v", p.Meta.Aliases))
+	}
+	if p.Meta.Author != "anders" || p.Meta.Custom["team"] != "infra" {
+		t.Error(fmt.Sprintf("wrong metadata %v", p.Meta))
+	}
+	if !strings.Contains(p.JSON(), `"tags":["ops","oncall"]`) {
+		t.Error(fmt.Sprintf("metadata should be in the JSON %s", p.JSON()))
+	}
+
+	if !(PageFilter{Tag: "ops", Fields: map[string]string{"team": "infra"}}).Matches(p) {
+		t.Error("should match the tag and custom field")
+	}
+	if (PageFilter{Author: "someone else"}).Matches(p) {
+		t.Error("shouldn't match a different author")
+	}
+
+	p.SetBody("+++\ntags = [\"db\"]\npriority = 2\n+++\nbody")
+	if len(p.Meta.Tags) != 1 || p.Meta.Tags[0] != "db" || p.Content() != "body" {
+		t.Error(fmt.Sprintf("didn't handle TOML front matter %v", p.Meta))
+	}
+	if !(PageFilter{Fields: map[string]string{"priority": "2"}}).Matches(p) {
+		t.Error("should match non-string custom fields")
+	}
+
+	p.SetBody("---\ntags: [oops\n---\nbody")
+	if len(p.Meta.Tags) != 0 || !strings.HasPrefix(p.Content(), "---") {
+		t.Error("broken front matter should be left in the content")
+	}
+}
+
+func TestSetTags(t *testing.T) {
+	p := Page{Title: "Page"}
+	if !p.SetTags([]string{"Ops", " db ", "ops", ""}) {
+		t.Error("should be able to set tags")
+	}
+	if strings.Join(p.Tags, ",") != "ops,db" {
+		t.Error(fmt.Sprintf("tags should be normalized %v", p.Tags))
+	}
+	if p.SetTags([]string{"ops", "db"}) {
+		t.Error("setting the same tags should do nothing")
+	}
+	p.SetBody("---\ntags: [oncall, db]\n---\nbody")
+	if strings.Join(p.AllTags(), ",") != "ops,db,oncall" {
+		t.Error(fmt.Sprintf("should merge front matter tags %v", p.AllTags()))
+	}
+
+	index := NewPageIndex()
+	p.Slug = "page"
+	index.Update(p)
+	index.Update(Page{Slug: "other", Title: "Other", Tags: []string{"db"}})
+	counts := index.TagCounts()
+	if len(counts) != 3 || counts[0].Tag != "db" || counts[0].Count != 2 {
+		t.Error(fmt.Sprintf("wrong tag counts %v", counts))
+	}
+	if len(index.Find(PageFilter{Tag: "oncall"})) != 1 {
+		t.Error("should find pages by front matter tags")
+	}
+}
+
+func TestHierarchicalLinks(t *testing.T) {
+	if slugify("Team / On Call") != "team/on-call" {
+		t.Error(fmt.Sprintf("bad hierarchical slug %s", slugify("Team / On Call")))
+	}
+	if slugify("/team//oncall/") != "team/oncall" {
+		t.Error(fmt.Sprintf("should drop empty parts %s", slugify("/team//oncall/")))
+	}
+	cases := map[string]string{
+		"team/oncall":     "team/oncall",
+		"./runbook":       "team/runbook",
+		"../faq":          "faq",
+		"../../../faq":    "faq",
+		"./sub/Deep Page": "team/sub/deep-page",
+	}
+	for target, expected := range cases {
+		if resolveLink(target, "team/oncall") != expected {
+			t.Error(fmt.Sprintf("%s resolved to %s", target, resolveLink(target, "team/oncall")))
+		}
+	}
+
+	p := Page{Slug: "team/oncall"}
+	p.SetBody("[[./runbook|the runbook]] [[team/escalation]]")
+	if p.LinkText() != "[the runbook](/page/team/runbook/) [team/escalation](/page/team/escalation/)" {
+		t.Error(fmt.Sprintf("didn't resolve links %s", p.LinkText()))
+	}
+
+	parents := parentSlugs("team/oncall/runbook")
+	if len(parents) != 2 || parents[0] != "team" || parents[1] != "team/oncall" {
+		t.Error(fmt.Sprintf("wrong parents %v", parents))
+	}
+
+	index := NewPageIndex()
+	index.Update(Page{Slug: "team", Title: "Team"})
+	index.Update(Page{Slug: "team/oncall", Title: "Oncall"})
+	index.Update(Page{Slug: "teams", Title: "Teams"})
+	subpages := index.Subpages("team")
+	if len(subpages) != 1 || subpages[0].Slug != "team/oncall" {
+		t.Error(fmt.Sprintf("wrong subpages %v", subpages))
+	}
+}
+
+func TestUnicodeSlugify(t *testing.T) {
+	cases := map[string]string{
+		"What is this?":       "what-is-this",
+		"C#":                  "c-sharp",
+		"C++ tips":            "c-plus-plus-tips",
+		"Q&A":                 "q-and-a",
+		"Q and A":             "q-and-a",
+		"Café Menu":           "café-menu",
+		"Cafe\u0301 Menu":     "café-menu",
+		"東京 の 天気":             "東京-の-天気",
+		"Template:Runbook":    "template:runbook",
+		"release v1.2 (beta)": "release-v1.2-beta",
+	}
+	for title, expected := range cases {
+		if slugify(title) != expected {
+			t.Error(fmt.Sprintf("%q slugified to %q", title, slugify(title)))
+		}
+	}
+
+	transliterateSlugs = true
+	defer func() { transliterateSlugs = false }()
+	if slugify("Café Straße") != "cafe-strasse" {
+		t.Error(fmt.Sprintf("didn't transliterate %q", slugify("Café Straße")))
+	}
+}
+
+func TestMigrateSlugs(t *testing.T) {
+	es := memoryEventStore{}
+	for _, slug := range []string{"C++ Tips", "Q&A", "Q and A"} {
+		es.Save(slug, EventList{CreateSetTitleEvent(slug, slug, ""), CreateSetBodyEvent(slug, "about "+slug, "")})
+	}
+	if err := migrateSlugs(es); err != nil {
+		t.Fatal(err)
+	}
+	if p := es["c-plus-plus-tips"].Apply(); p.Body != "about C++ Tips" {
+		t.Error(fmt.Sprintf("should've moved the page %v", p))
+	}
+	if p := es["C++ Tips"].Apply(); p.RedirectTo != "c-plus-plus-tips" {
+		t.Error("should've left a redirect behind")
+	}
+	// neither of these gets to be q-and-a just by coming first
+	if len(es["q-and-a"]) != 0 {
+		t.Error(fmt.Sprintf("two pages shouldn't be moved to the same slug %v", es["q-and-a"].Apply()))
+	}
+	for _, slug := range []string{"Q&A", "Q and A"} {
+		if p := es[slug].Apply(); p.RedirectTo != "" || p.Body != "about "+slug {
+			t.Error(fmt.Sprintf("%s should've been left alone %v", slug, p))
+		}
+	}
+}
+
+func TestAliases(t *testing.T) {
+	index := NewPageIndex()
+	k8s := Page{Slug: "kubernetes", Title: "Kubernetes"}
+	k8s.SetBody("---\naliases: [k8s, Kube]\n---\nbody")
+	index.Update(k8s)
+	index.Update(Page{Slug: "old-name", Title: "Old Name", RedirectTo: "k8s"})
+
+	for _, slug := range []string{"k8s", "kube", "kubernetes", "old-name"} {
+		if index.Canonical(slug) != "kubernetes" {
+			t.Error(fmt.Sprintf("%s should resolve to kubernetes, got %s", slug, index.Canonical(slug)))
+		}
+	}
+	if index.Canonical("nothing") != "nothing" {
+		t.Error("unknown slugs should be left alone")
+	}
+
+	canonicalSlug = index.Canonical
+	defer func() { canonicalSlug = func(slug string) string { return slug } }()
+	p := Page{}
+	p.SetBody("[[k8s]]")
+	if p.LinkText() != "[k8s](/page/kubernetes/)" {
+		t.Error(fmt.Sprintf("links should follow aliases %s", p.LinkText()))
+	}
+
+	k8s.SetBody("no more aliases")
+	index.Update(k8s)
+	if index.Canonical("k8s") != "k8s" {
+		t.Error("removed aliases should go away")
+	}
+}
+
+func TestIndexConcurrency(t *testing.T) {
+	index := NewPageIndex()
+	defer func(original func(string) string) { canonicalSlug = original }(canonicalSlug)
+	canonicalSlug = index.Canonical
+	index.Update(Page{Slug: "inner", Title: "Inner", Body: "inside"})
+	index.Update(Page{Slug: "outer", Title: "Outer", Body: "{{include: inner}}"})
+
+	done := make(chan bool)
+	go func() {
+		for n := 0; n < 2000; n++ {
+			index.Update(Page{Slug: fmt.Sprintf("page-%d", n%50), Title: "Page", Body: "{{include: inner}}"})
+		}
+		done <- true
+	}()
+	go func() {
+		for n := 0; n < 2000; n++ {
+			index.IncludedBy("inner")
+		}
+		done <- true
+	}()
+	for n := 0; n < 2; n++ {
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatal("IncludedBy and Update deadlocked")
+		}
+	}
+	if by := index.IncludedBy("inner"); len(by) != 51 {
+		t.Error(fmt.Sprintf("wrong included by %d", len(by)))
+	}
+}
+
+func TestFileLinks(t *testing.T) {
+	p := Page{Slug: "team/oncall"}
+	p.SetBody("[[File:diagram.png]] [[file:Run Book.pdf|the runbook]]")
+	expected := "![diagram.png](/attachments/team/oncall/diagram.png) [the runbook](/attachments/team/oncall/Run%20Book.pdf)"
+	if p.LinkText() != expected {
+		t.Error(fmt.Sprintf("didn't handle file links %s", p.LinkText()))
+	}
+
+	if !p.Attach(Attachment{Name: "diagram.png", Hash: "a"}) {
+		t.Error("should be able to attach a file")
+	}
+	if p.Attach(Attachment{Name: "diagram.png", Hash: "a"}) {
+		t.Error("attaching the same file again should do nothing")
+	}
+	if !p.Attach(Attachment{Name: "diagram.png", Hash: "b"}) || len(p.Attachments) != 1 {
+		t.Error("a new version should replace the old one")
+	}
+	if a, ok := p.Attachment("diagram.png"); !ok || a.Hash != "b" {
+		t.Error("didn't find the attachment")
+	}
+}
+
+func TestLocalBlobStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gori-blobs")
+	defer os.RemoveAll(dir)
+	store, err := NewLocalBlobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, size, err := store.Put(strings.NewReader("hello"))
+	if err != nil || size != 5 {
+		t.Fatal(fmt.Sprintf("couldn't store blob %v %d", err, size))
+	}
+	again, _, _ := store.Put(strings.NewReader("hello"))
+	if again != hash {
+		t.Error("same content should get the same hash")
+	}
+	f, err := store.Open(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, _ := ioutil.ReadAll(f)
+	if string(data) != "hello" {
+		t.Error(fmt.Sprintf("got back %q", data))
+	}
+	if _, err := store.Open("../../etc/passwd"); err == nil {
+		t.Error("should only open things that look like hashes")
+	}
+}
+
+func TestThumbnails(t *testing.T) {
+	p := Page{Slug: "shots"}
+	p.SetBody("[[File:big.png|300px|a screenshot]] [[File:big.png|x50px]]")
+	expected := "[![a screenshot](/attachments/shots/big.png?w=300)](/attachments/shots/big.png) " +
+		"[![big.png](/attachments/shots/big.png?h=50)](/attachments/shots/big.png)"
+	if p.LinkText() != expected {
+		t.Error(fmt.Sprintf("didn't handle image sizes %s", p.LinkText()))
+	}
+	p.SetBody("[[File:big.png|3000x99999999999999999999px]]")
+	expected = "[![big.png](/attachments/shots/big.png?h=2000&w=2000)](/attachments/shots/big.png)"
+	if p.LinkText() != expected {
+		t.Error(fmt.Sprintf("should clamp sizes to what can be thumbnailed %s", p.LinkText()))
+	}
+
+	bounds := image.Rect(0, 0, 1000, 500)
+	if w, h := thumbnailSize(bounds, 300, 0); w != 300 || h != 150 {
+		t.Error(fmt.Sprintf("bad size %dx%d", w, h))
+	}
+	if w, h := thumbnailSize(bounds, 300, 50); w != 100 || h != 50 {
+		t.Error(fmt.Sprintf("should fit inside both %dx%d", w, h))
+	}
+	if w, h := thumbnailSize(bounds, 5000, 0); w != 1000 || h != 500 {
+		t.Error(fmt.Sprintf("shouldn't scale up %dx%d", w, h))
+	}
+
+	dir, _ := ioutil.TempDir("", "gori-thumbs")
+	defer os.RemoveAll(dir)
+	store, _ := NewLocalBlobStore(dir)
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(bounds))
+	hash, _, _ := store.Put(&buf)
+	thumbnailer, _ := NewThumbnailer(store, filepath.Join(dir, "thumbnails"))
+	path, err := thumbnailer.Thumbnail(Attachment{Hash: hash, ContentType: "image/png"}, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _ := os.Open(path)
+	defer f.Close()
+	thumb, _, err := image.DecodeConfig(f)
+	if err != nil || thumb.Width != 100 || thumb.Height != 50 {
+		t.Error(fmt.Sprintf("bad thumbnail %v %v", thumb, err))
+	}
+	if _, err := thumbnailer.Thumbnail(Attachment{Hash: hash, ContentType: "application/pdf"}, 100, 0); err != errNotThumbnailable {
+		t.Error("should only thumbnail images")
+	}
+
+	// sizes that come out the same share a file
+	if again, _ := thumbnailer.Thumbnail(Attachment{Hash: hash, ContentType: "image/png"}, 100, 60); again != path {
+		t.Error(fmt.Sprintf("should've reused the thumbnail %s %s", again, path))
+	}
+	thumbnailer.Thumbnail(Attachment{Hash: hash, ContentType: "image/png"}, 1500, 0)
+	thumbnailer.Thumbnail(Attachment{Hash: hash, ContentType: "image/png"}, 2000, 0)
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "thumbnails")); len(files) != 2 {
+		t.Error(fmt.Sprintf("too big should all be the one thumbnail %d", len(files)))
+	}
+
+	// a png that's only a header claiming to be 100000x100000
+	header := []byte{0, 1, 0x86, 0xa0, 0, 1, 0x86, 0xa0, 8, 2, 0, 0, 0}
+	buf.Reset()
+	buf.Write([]byte("\x89PNG\r\n\x1a\n"))
+	binary.Write(&buf, binary.BigEndian, uint32(len(header)))
+	chunk := append([]byte("IHDR"), header...)
+	buf.Write(chunk)
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+	huge, _, _ := store.Put(&buf)
+	if _, err := thumbnailer.Thumbnail(Attachment{Hash: huge, ContentType: "image/png"}, 100, 0); err != errNotThumbnailable {
+		t.Error(fmt.Sprintf("shouldn't decode huge images %v", err))
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	templates, err := NewTemplates("", false, Site{Name: "gori"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	templates.Render(w, "view.html", PageResponse{Title: "Hello", Slug: "hello", Body: "<p>hi</p>"})
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "<title>Hello - gori</title>") {
+		t.Error(fmt.Sprintf("didn't render the page %d %s", w.Code, w.Body.String()))
+	}
+	if !strings.Contains(w.Body.String(), "/highlight.css") {
+		t.Error("view should add the highlighting css to the head")
+	}
+
+	dir, _ := ioutil.TempDir("", "gori-templates")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "_nav.html"), []byte(`{{define "nav"}}custom nav{{end}}`), 0644)
+	templates, err = NewTemplates(dir, true, Site{Name: "gori"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	templates.Render(w, "list.html", PageListResponse{Heading: "Pages"})
+	if !strings.Contains(w.Body.String(), "custom nav") {
+		t.Error("templates in the directory should override the built in ones")
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "list.html"), []byte(`{{define "content"}}{{.Nope}}{{end}}`), 0644)
+	w = httptest.NewRecorder()
+	templates.Render(w, "list.html", PageListResponse{Heading: "Pages"})
+	if w.Code != 500 {
+		t.Error(fmt.Sprintf("a broken template should be an error, not half a page %d", w.Code))
+	}
+}
+
+func TestThemes(t *testing.T) {
+	theme, err := LoadTheme("media", "bootstrap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if theme.Stylesheets[len(theme.Stylesheets)-1] != "/media/themes/bootstrap/theme.css" {
+		t.Error(fmt.Sprintf("relative paths should be in the theme's directory %v", theme.Stylesheets))
+	}
+	if _, err := LoadTheme("media", "plain"); err != nil {
+		t.Error(err)
+	}
+	if _, err := LoadTheme("media", "nonexistent"); err == nil {
+		t.Error("a missing theme should be an error")
+	}
+
+	links := parseNavLinks("about|/page/about/, broken, source | https://github.com/thraxil/gori")
+	if len(links) != 2 || links[1].Label != "source" || links[1].URL != "https://github.com/thraxil/gori" {
+		t.Error(fmt.Sprintf("wrong nav links %v", links))
+	}
+
+	site := Site{
+		Name:     "Team Wiki",
+		Logo:     "/media/logo.png",
+		Footer:   template.HTML("run by <a href=\"/page/infra/\">infra</a>"),
+		Theme:    theme,
+		CSS:      []string{"/media/custom.css"},
+		NavLinks: links,
+	}
+	templates, err := NewTemplates("", false, site)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	templates.Render(w, "tags.html", []TagCloudEntry{})
+	out := w.Body.String()
+	for _, expected := range []string{
+		"<title>Tags - Team Wiki</title>",
+		`src="/media/logo.png"`,
+		`<a href="/page/infra/">infra</a>`,
+		`href="/media/themes/bootstrap/theme.css"`,
+		`<a href="/page/about/">about</a>`,
+		`<script src="/media/bootstrap/js/bootstrap.js">`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Error(fmt.Sprintf("expected %q in %s", expected, out))
+		}
+	}
+	if strings.Index(out, "/media/custom.css") < strings.Index(out, "/media/themes/bootstrap/theme.css") {
+		t.Error("custom css should come after the theme's")
+	}
+	if strings.Contains(out, "anders pearson") || strings.Contains(out, "twitter") {
+		t.Error("nothing site specific should be hardcoded")
+	}
+}
+
+// formRequest is a POST of form to path from the "session" session, with
+// a good CSRF token unless the form already has one
+func formRequest(ctx Context, path string, form url.Values) *http.Request {
+	if form.Get("csrf_token") == "" {
+		form.Set("csrf_token", ctx.CSRF.tokenFor("session"))
+	}
+	r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "session"})
+	return r
+}
+
+// postForm sends a formRequest through the wiki's routes
+func postForm(t *testing.T, ctx Context, path string, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	wikiRoutes(ctx).ServeHTTP(w, formRequest(ctx, path, form))
+	return w
+}
+
+func TestPreview(t *testing.T) {
+	index := NewPageIndex()
+	index.Update(Page{Slug: "team/inner", Title: "Inner", Body: "included text"})
+	csrf := NewCSRF("secret", false)
+	ctx := Context{CSRF: csrf, Transcluder: NewTranscluder(index, defaultMaxIncludeDepth)}
+
+	form := url.Values{}
+	form.Set("body", "see [[./runbook]]\n\n{{include: team/inner}}")
+	w := postForm(t, ctx, "/preview/team/oncall/", form)
+	out := w.Body.String()
+	if w.Code != 200 || !strings.Contains(out, `<a href="/page/team/runbook/">`) {
+		t.Error(fmt.Sprintf("links should resolve relative to the page %d %s", w.Code, out))
+	}
+	if !strings.Contains(out, "included text") {
+		t.Error(fmt.Sprintf("includes should be expanded %s", out))
+	}
+	if p, _ := index.FindBySlug("team/oncall"); p != nil && p.Exists() {
+		t.Error("preview shouldn't save anything")
+	}
+
+	form.Set("csrf_token", "wrong")
+	if w := postForm(t, ctx, "/preview/team/oncall/", form); w.Code != 403 {
+		t.Error(fmt.Sprintf("preview should check the CSRF token %d", w.Code))
+	}
+}
+
+type memoryDraftStore map[string]Draft
+
+func (m memoryDraftStore) Get(owner, slug string) (*Draft, error) {
+	d, ok := m[owner+" "+slug]
+	if !ok {
+		return nil, nil
+	}
+	return &d, nil
+}
+
+func (m memoryDraftStore) Save(d Draft) error {
+	m[d.Owner+" "+d.Slug] = d
+	return nil
+}
+
+func (m memoryDraftStore) Discard(owner, slug string) error {
+	delete(m, owner+" "+slug)
+	return nil
+}
+
+func TestDrafts(t *testing.T) {
+	index := NewPageIndex()
+	index.Update(Page{Slug: "notes", Title: "Notes", Body: "saved body", Modified: time.Now().Add(-time.Hour)})
+	templates, err := NewTemplates("", false, Site{Name: "gori"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrf := NewCSRF("secret", false)
+	drafts := memoryDraftStore{}
+	ctx := Context{
+		PageReadRepo: index,
+		Index:        index,
+		Auth:         NewAuth("X-Remote-User", ""),
+		CSRF:         csrf,
+		Templates:    templates,
+		Drafts:       drafts,
+	}
+	post := func(form url.Values) *httptest.ResponseRecorder {
+		r := formRequest(ctx, "/draft/notes/", form)
+		r.Header.Set("X-Remote-User", "alice")
+		w := httptest.NewRecorder()
+		wikiRoutes(ctx).ServeHTTP(w, r)
+		return w
+	}
+	edit := func(user string) string {
+		r := httptest.NewRequest("GET", "/edit/notes/", nil)
+		r.Header.Set("X-Remote-User", user)
+		r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "session"})
+		w := httptest.NewRecorder()
+		wikiRoutes(ctx).ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	w := post(url.Values{"title": {"Notes"}, "body": {"half written"}, "tags": {"wip"}})
+	if w.Code != http.StatusNoContent {
+		t.Error(fmt.Sprintf("saving a draft should be a 204 %d %s", w.Code, w.Body.String()))
+	}
+	if d, _ := drafts.Get("alice", "notes"); d == nil || d.Body != "half written" {
+		t.Error(fmt.Sprintf("draft wasn't saved %v", drafts))
+	}
+	out := edit("alice")
+	if !strings.Contains(out, "half written") || !strings.Contains(out, "unsaved draft") {
+		t.Error(fmt.Sprintf("the edit form should restore the draft %s", out))
+	}
+	if strings.Contains(out, "has been changed since") {
+		t.Error("the draft is newer than the page")
+	}
+	if out := edit("bob"); strings.Contains(out, "half written") {
+		t.Error("drafts belong to whoever wrote them")
+	}
+
+	index.Update(Page{Slug: "notes", Title: "Notes", Body: "someone else", Version: 1})
+	if out := edit("alice"); !strings.Contains(out, "has been changed since") {
+		t.Error("should warn when the page changed after the draft was saved")
+	}
+
+	w = post(url.Values{"discard": {"true"}})
+	if w.Code != http.StatusSeeOther {
+		t.Error(fmt.Sprintf("discarding should go back to the form %d", w.Code))
+	}
+	if d, _ := drafts.Get("alice", "notes"); d != nil {
+		t.Error("draft should've been discarded")
+	}
+}
+
+func TestSections(t *testing.T) {
+	body := "---\ntags: [a]\n---\nintro\n\n# One\none\n\n## One A\n```\n# not a heading\n```\n\n# Two ##\ntwo\n"
+	p := Page{Body: body}
+	sections := p.Sections()
+	if len(sections) != 3 || sections[0].Title != "One" || sections[1].Level != 2 || sections[2].Title != "Two" {
+		t.Error(fmt.Sprintf("wrong sections %v", sections))
+	}
+	if s, _ := getSection(body, 0); s != "intro\n\n" {
+		t.Error(fmt.Sprintf("section 0 should be the intro, without the front matter %q", s))
+	}
+	if s, _ := getSection(body, 1); s != "# One\none\n\n## One A\n```\n# not a heading\n```\n\n" {
+		t.Error(fmt.Sprintf("a section should include its subsections %q", s))
+	}
+	if _, ok := getSection(body, 4); ok {
+		t.Error("there's no section 4")
+	}
+	replaced, _ := replaceSection(body, 2, "## One A\nchanged")
+	if replaced != "---\ntags: [a]\n---\nintro\n\n# One\none\n\n## One A\nchanged\n# Two ##\ntwo\n" {
+		t.Error(fmt.Sprintf("didn't splice the section back in %q", replaced))
+	}
+}
+
+// memoryWriteRepo saves straight into a PageIndex, for testing handlers
+type memoryWriteRepo struct {
+	index *PageIndex
+}
+
+func (m memoryWriteRepo) update(p *Page) error {
+	p.Modified = time.Now()
+	p.Version++
+	m.index.Update(*p)
+	return nil
+}
+
+func (m memoryWriteRepo) SetTitle(p *Page, title string) error {
+	p.SetTitle(title)
+	return m.update(p)
+}
+
+func (m memoryWriteRepo) SetBody(p *Page, body string) error {
+	p.SetBody(body)
+	return m.update(p)
+}
+
+func (m memoryWriteRepo) SetTags(p *Page, tags []string) error {
+	p.SetTags(tags)
+	return m.update(p)
+}
+
+func (m memoryWriteRepo) Save(p *Page, title, body string, tags []string) error {
+	if current, _ := m.index.FindBySlug(p.Slug); current.Version != p.Version {
+		return errVersionConflict
+	}
+	p.SetTitle(title)
+	p.SetBody(body)
+	p.SetTags(tags)
+	return m.update(p)
+}
+
+func (m memoryWriteRepo) Attach(p *Page, a Attachment, user string) error {
+	p.Attach(a)
+	return m.update(p)
+}
+
+func (m memoryWriteRepo) Protect(p *Page, user string) error {
+	p.SetProtected(true)
+	return m.update(p)
+}
+
+func (m memoryWriteRepo) Unprotect(p *Page, user string) error {
+	p.SetProtected(false)
+	return m.update(p)
+}
+
+func TestSectionEditing(t *testing.T) {
+	index := NewPageIndex()
+	index.Update(Page{Slug: "big", Title: "Big", Body: "intro\n# One\none\n# Two\ntwo\n"})
+	templates, err := NewTemplates("", false, Site{Name: "gori"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrf := NewCSRF("secret", false)
+	ctx := Context{
+		PageReadRepo:  index,
+		PageWriteRepo: memoryWriteRepo{index},
+		Index:         index,
+		Auth:          NewAuth("X-Remote-User", ""),
+		CSRF:          csrf,
+		Templates:     templates,
+		Drafts:        memoryDraftStore{},
+	}
+
+	r := httptest.NewRequest("GET", "/edit/big/?section=2", nil)
+	w := httptest.NewRecorder()
+	wikiRoutes(ctx).ServeHTTP(w, r)
+	out := w.Body.String()
+	if !strings.Contains(out, "# Two\ntwo\n</textarea>") || strings.Contains(out, "# One\none") {
+		t.Error(fmt.Sprintf("should only have section 2 in the form %s", out))
+	}
+
+	// someone else edits section 1 in the meantime
+	p, _ := index.FindBySlug("big")
+	ctx.PageWriteRepo.SetBody(p, "intro\n# One\none, edited\n# Two\ntwo\n")
+
+	postForm(t, ctx, "/edit/big/", url.Values{"title": {"Big"}, "body": {"# Two\ntwo, also edited\n"}, "section": {"2"}})
+	p, _ = index.FindBySlug("big")
+	if p.Body != "intro\n# One\none, edited\n# Two\ntwo, also edited\n" {
+		t.Error(fmt.Sprintf("section wasn't spliced into the current body %q", p.Body))
+	}
+
+	r = httptest.NewRequest("GET", "/edit/big/?section=9", nil)
+	w = httptest.NewRecorder()
+	wikiRoutes(ctx).ServeHTTP(w, r)
+	if w.Code != 404 {
+		t.Error(fmt.Sprintf("missing section should be a 404 %d", w.Code))
+	}
+}
+
+func TestMerge3(t *testing.T) {
+	base := "one\ntwo\nthree\nfour\n"
+	merged, clean := merge3(base, "one\ntwo\nthree\nfour, theirs\n", "one, mine\ntwo\nthree\nfour\n")
+	if !clean || merged != "one, mine\ntwo\nthree\nfour, theirs\n" {
+		t.Error(fmt.Sprintf("changes to different lines should merge %v %q", clean, merged))
+	}
+	merged, clean = merge3(base, "one\ntwo\nthree\nfour\nfive\n", "zero\none\ntwo\nthree\nfour\n")
+	if !clean || merged != "zero\none\ntwo\nthree\nfour\nfive\n" {
+		t.Error(fmt.Sprintf("insertions at either end should merge %v %q", clean, merged))
+	}
+	merged, clean = merge3(base, "one\nthree\nfour\n", "one\ntwo\nthree\nfour, mine\n")
+	if !clean || merged != "one\nthree\nfour, mine\n" {
+		t.Error(fmt.Sprintf("a deletion and an edit elsewhere should merge %v %q", clean, merged))
+	}
+	merged, clean = merge3(base, "one\ntwo, same\nthree\nfour\n", "one\ntwo, same\nthree\nfour\n")
+	if !clean || merged != "one\ntwo, same\nthree\nfour\n" {
+		t.Error(fmt.Sprintf("the same change on both sides isn't a conflict %v %q", clean, merged))
+	}
+	merged, clean = merge3(base, "one\ntwo, theirs\nthree\nfour\n", "one\ntwo, mine\nthree\nfour\n")
+	expected := "one\n<<<<<<< your changes\ntwo, mine\n=======\ntwo, theirs\n>>>>>>> saved version\nthree\nfour\n"
+	if clean || merged != expected {
+		t.Error(fmt.Sprintf("overlapping changes should conflict %v %q", clean, merged))
+	}
+	if merged, _ := merge3("a\r\nb\r\n", "a\r\nb\r\n", "a\r\nb, mine\r\n"); merged != "a\nb, mine\n" {
+		t.Error(fmt.Sprintf("line endings shouldn't matter %q", merged))
+	}
+	merged, clean = merge3("a\nb\nc\n", "a\nX\nb\nc\n", "a\nb\nY\nc\n")
+	if !clean || merged != "a\nX\nb\nY\nc\n" {
+		t.Error(fmt.Sprintf("should keep the last newline %v %q", clean, merged))
+	}
+	if merged, _ := merge3("a\nb", "a\nb", "a, mine\nb"); merged != "a, mine\nb" {
+		t.Error(fmt.Sprintf("shouldn't add a last newline either %q", merged))
+	}
+
+	// every line changed on both sides is one big conflict
+	var big, theirs, mine strings.Builder
+	for n := 0; n < 3000; n++ {
+		fmt.Fprintf(&big, "line %d\n", n)
+		fmt.Fprintf(&theirs, "line %d, theirs\n", n)
+		fmt.Fprintf(&mine, "line %d, mine\n", n)
+	}
+	merged, clean = merge3("top\n"+big.String(), "top\n"+theirs.String(), "top\n"+mine.String())
+	if clean || !strings.HasPrefix(merged, "top\n"+conflictStart+mine.String()+conflictSep+theirs.String()+conflictEnd) {
+		t.Error(fmt.Sprintf("should be one conflict %v", clean))
+	}
+	merged, clean = merge3(big.String(), big.String(), mine.String())
+	if !clean || merged != mine.String() {
+		t.Error("changes on only one side should still merge")
+	}
+	// changes far apart in a big page don't get lumped together
+	lines := strings.SplitAfter(big.String(), "\n")
+	lines = lines[:len(lines)-1]
+	edit := func(changes map[int]string) string {
+		edited := append([]string{}, lines...)
+		for n, line := range changes {
+			edited[n] = line
+		}
+		return strings.Join(edited, "")
+	}
+	merged, clean = merge3(big.String(), edit(map[int]string{1500: "theirs\n"}), edit(map[int]string{1: "mine\n", 2998: "mine\n"}))
+	if !clean || merged != edit(map[int]string{1: "mine\n", 1500: "theirs\n", 2998: "mine\n"}) {
+		t.Error(fmt.Sprintf("edits to different parts of a big page should merge %v", clean))
+	}
+	// and something enormous doesn't take forever
+	var huge strings.Builder
+	for n := 0; n < 100000; n++ {
+		fmt.Fprintf(&huge, "%d\n", n)
+	}
+	start := time.Now()
+	if _, clean := merge3(huge.String(), "x\n"+huge.String(), strings.Replace(huge.String(), "\n", " \n", -1)); clean {
+		t.Error("rewriting every line while someone else changes one is a conflict")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error(fmt.Sprintf("merging took %s", time.Since(start)))
+	}
+}
+
+// memoryEventStore keeps events in a map instead of postgres
+type memoryEventStore map[string]EventList
+
+func (m memoryEventStore) Save(id string, events EventList) error {
+	m[id] = append(m[id], events...)
+	return nil
+}
+
+func (m memoryEventStore) SaveAtVersion(id string, version int, events EventList) error {
+	if len(m[id]) != version {
+		return errVersionConflict
+	}
+	return m.Save(id, events)
+}
+
+func (m memoryEventStore) GetEventsFor(id string) (EventList, error) {
+	return m[id], nil
+}
+
+func (m memoryEventStore) AggregateIDs() ([]string, error) {
+	ids := make([]string, 0)
+	for id := range m {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (m memoryEventStore) Dispatch(command string) Event {
+	return NewPageEventRegistry().Dispatch(command)
+}
+
+func TestEditMerging(t *testing.T) {
+	es := memoryEventStore{}
+	index := NewPageIndex()
+	repo := NewEventStoreRepo(es, index)
+	templates, err := NewTemplates("", false, Site{Name: "gori"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrf := NewCSRF("secret", false)
+	ctx := Context{
+		PageReadRepo:  repo,
+		PageWriteRepo: repo,
+		EventStore:    es,
+		Index:         index,
+		Auth:          NewAuth("X-Remote-User", ""),
+		CSRF:          csrf,
+		Templates:     templates,
+		Drafts:        memoryDraftStore{},
+	}
+	p := &Page{Slug: "shared"}
+	repo.SetTitle(p, "Shared")
+	repo.SetBody(p, "one\ntwo\nthree\n")
+	base := p.Version
+
+	save := func(form url.Values) *httptest.ResponseRecorder {
+		return postForm(t, ctx, "/edit/shared/", form)
+	}
+	version := strconv.Itoa(base)
+
+	// alice and bob both load the form at the same version
+	save(url.Values{"title": {"Shared"}, "body": {"one, alice\ntwo\nthree\n"}, "version": {version}})
+	w := save(url.Values{"title": {"Shared"}, "body": {"one\ntwo\nthree, bob\n"}, "version": {version}})
+	if w.Code != http.StatusFound {
+		t.Error(fmt.Sprintf("a clean merge should just save %d", w.Code))
+	}
+	p, _ = repo.FindBySlug("shared")
+	if p.Body != "one, alice\ntwo\nthree, bob\n" {
+		t.Error(fmt.Sprintf("both edits should be kept %q", p.Body))
+	}
+
+	w = save(url.Values{"title": {"Shared"}, "body": {"one, carol\ntwo\nthree\n"}, "version": {version}})
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "&lt;&lt;&lt;&lt;&lt;&lt;&lt; your changes\none, carol") {
+		t.Error(fmt.Sprintf("overlapping edits should come back with markers %d %s", w.Code, w.Body.String()))
+	}
+	if !strings.Contains(w.Body.String(), `name="version" value="`+strconv.Itoa(p.Version)+`"`) {
+		t.Error("the conflict form should be based on the current version")
+	}
+	p, _ = repo.FindBySlug("shared")
+	if p.Body != "one, alice\ntwo\nthree, bob\n" {
+		t.Error(fmt.Sprintf("a conflict shouldn't save anything %q", p.Body))
+	}
+}
+
+// racingEventStore lets someone else save just before the next save
+// that checks the version, like a second request that got there first
+type racingEventStore struct {
+	memoryEventStore
+	race func()
+}
+
+func (r *racingEventStore) SaveAtVersion(id string, version int, events EventList) error {
+	if r.race != nil {
+		race := r.race
+		r.race = nil
+		race()
+	}
+	return r.memoryEventStore.SaveAtVersion(id, version, events)
+}
+
+func TestSaveRaces(t *testing.T) {
+	es := &racingEventStore{memoryEventStore: memoryEventStore{}}
+	index := NewPageIndex()
+	repo := NewEventStoreRepo(es, index)
+	templates, err := NewTemplates("", false, Site{Name: "gori"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := Context{
+		PageReadRepo:  repo,
+		PageWriteRepo: repo,
+		EventStore:    es,
+		Index:         index,
+		Auth:          NewAuth("X-Remote-User", ""),
+		CSRF:          NewCSRF("secret", false),
+		Templates:     templates,
+		Drafts:        memoryDraftStore{},
+	}
+	p := &Page{Slug: "shared"}
+	repo.Save(p, "Shared", "one\ntwo\nthree\n", nil)
+	if p.Version != 2 {
+		t.Error(fmt.Sprintf("should have saved the title and body %d", p.Version))
+	}
+	version := strconv.Itoa(p.Version)
+
+	// bob's save gets in after alice's request has read the page
+	es.race = func() {
+		bob, _ := repo.FindBySlug("shared")
+		if err := repo.Save(bob, "Shared", "one\ntwo\nthree, bob\n", []string{"bob"}); err != nil {
+			t.Error(err)
+		}
+	}
+	w := postForm(t, ctx, "/edit/shared/", url.Values{"title": {"Shared"}, "body": {"one, alice\ntwo\nthree\n"}, "version": {version}})
+	if w.Code != http.StatusFound {
+		t.Error(fmt.Sprintf("should have merged with bob's save %d %s", w.Code, w.Body.String()))
+	}
+	p, _ = repo.FindBySlug("shared")
+	if p.Body != "one, alice\ntwo\nthree, bob\n" || strings.Join(p.Tags, ",") != "bob" {
+		t.Error(fmt.Sprintf("one save shouldn't overwrite the other %q %v", p.Body, p.Tags))
+	}
+
+	// a stale page doesn't get any of its changes saved
+	stale := &Page{Slug: "shared", Version: 1}
+	if err := repo.Save(stale, "Stale", "stale\n", []string{"stale"}); err != errVersionConflict {
+		t.Error(fmt.Sprintf("saving an old version should be a conflict %v", err))
+	}
+	p, _ = repo.FindBySlug("shared")
+	if p.Title != "Shared" || p.Body != "one, alice\ntwo\nthree, bob\n" {
+		t.Error(fmt.Sprintf("a conflicting save shouldn't save part of itself %v", p))
+	}
+}
+
+func TestProtectedEditing(t *testing.T) {
+	es := memoryEventStore{}
+	index := NewPageIndex()
+	repo := NewEventStoreRepo(es, index)
+	templates, err := NewTemplates("", false, Site{Name: "gori"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := Context{
+		PageReadRepo:  repo,
+		PageWriteRepo: repo,
+		EventStore:    es,
+		Index:         index,
+		Auth:          NewAuth("X-Remote-User", "alice"),
+		CSRF:          NewCSRF("secret", false),
+		Templates:     templates,
+		Drafts:        memoryDraftStore{},
+	}
+	p := &Page{Slug: "locked"}
+	repo.SetTitle(p, "Locked")
+	repo.SetBody(p, "original")
+
+	// every request here has a good CSRF token, so it's the admin check
+	// that decides
+	post := func(user, path string, form url.Values) *httptest.ResponseRecorder {
+		r := formRequest(ctx, path, form)
+		r.Header.Set("X-Remote-User", user)
+		w := httptest.NewRecorder()
+		wikiRoutes(ctx).ServeHTTP(w, r)
+		return w
+	}
+	if w := post("bob", "/protect/locked/", url.Values{}); w.Code != 403 {
+		t.Error(fmt.Sprintf("only admins can protect pages %d", w.Code))
+	}
+	if w := post("alice", "/protect/locked/", url.Values{}); w.Code != http.StatusFound {
+		t.Error(fmt.Sprintf("admins can protect pages %d", w.Code))
+	}
+	if p, _ := repo.FindBySlug("locked"); !p.Protected {
+		t.Fatal("page should be protected now")
+	}
+
+	if w := post("bob", "/edit/locked/", url.Values{"title": {"Locked"}, "body": {"bob was here"}}); w.Code != 403 {
+		t.Error(fmt.Sprintf("non-admins can't edit protected pages %d", w.Code))
+	}
+	if p, _ := repo.FindBySlug("locked"); p.Body != "original" {
+		t.Error(fmt.Sprintf("a refused edit shouldn't save anything %q", p.Body))
+	}
+	if w := post("alice", "/edit/locked/", url.Values{"title": {"Locked"}, "body": {"alice was here"}}); w.Code != http.StatusFound {
+		t.Error(fmt.Sprintf("admins can edit protected pages %d", w.Code))
+	}
+	if p, _ := repo.FindBySlug("locked"); p.Body != "alice was here" {
+		t.Error(fmt.Sprintf("the admin's edit should be saved %q", p.Body))
+	}
+}
+
+// unreadBody fails the test if the handler reads any of the request body
+type unreadBody struct {
+	t *testing.T
+}
+
+func (b unreadBody) Read(p []byte) (int, error) {
+	b.t.Error("the body shouldn't have been read")
+	return 0, io.EOF
+}
+
+func TestAttachHandler(t *testing.T) {
+	es := memoryEventStore{}
+	index := NewPageIndex()
+	repo := NewEventStoreRepo(es, index)
+	dir, _ := ioutil.TempDir("", "gori-attach")
+	defer os.RemoveAll(dir)
+	blobs, _ := NewLocalBlobStore(dir)
+	templates, err := NewTemplates("", false, Site{Name: "gori"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := Context{
+		PageReadRepo:  repo,
+		PageWriteRepo: repo,
+		EventStore:    es,
+		Index:         index,
+		Auth:          NewAuth("X-Remote-User", ""),
+		CSRF:          NewCSRF("secret", false),
+		Templates:     templates,
+		Drafts:        memoryDraftStore{},
+		Blobs:         blobs,
+		MaxUploadSize: 1 << 20,
+	}
+	repo.SetTitle(&Page{Slug: "notes"}, "Notes")
+
+	// the edit form sends the token in the query string
+	r := httptest.NewRequest("GET", "/edit/notes/", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "session"})
+	w := httptest.NewRecorder()
+	wikiRoutes(ctx).ServeHTTP(w, r)
+	if !strings.Contains(w.Body.String(), `action="/attach/notes/?csrf_token=`+ctx.CSRF.tokenFor("session")+`"`) {
+		t.Error(fmt.Sprintf("the upload form should have the token in its action %s", w.Body.String()))
+	}
+
+	// a forged upload is turned away before reading any of it
+	r = httptest.NewRequest("POST", "/attach/notes/?csrf_token=wrong", unreadBody{t})
+	r.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+	r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "session"})
+	w = httptest.NewRecorder()
+	wikiRoutes(ctx).ServeHTTP(w, r)
+	if w.Code != 403 {
+		t.Error(fmt.Sprintf("bad token should be a 403 %d", w.Code))
+	}
+
+	upload := func(slug, token, user, name, content string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		part, _ := mw.CreateFormFile("file", name)
+		part.Write([]byte(content))
+		mw.Close()
+		r := httptest.NewRequest("POST", "/attach/"+slug+"/?csrf_token="+token, &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		r.Header.Set("X-Remote-User", user)
+		r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "session"})
+		w := httptest.NewRecorder()
+		wikiRoutes(ctx).ServeHTTP(w, r)
+		return w
+	}
+	token := ctx.CSRF.tokenFor("session")
+
+	if w := upload("notes", "wrong", "", "notes.txt", "hello"); w.Code != 403 {
+		t.Error(fmt.Sprintf("bad token should be a 403 %d", w.Code))
+	}
+	if w := upload("notes", token, "", "../../notes.txt", "hello"); w.Code != http.StatusFound {
+		t.Error(fmt.Sprintf("upload should go back to the edit form %d %s", w.Code, w.Body.String()))
+	}
+	p, _ := repo.FindBySlug("notes")
+	if _, ok := p.Attachment("notes.txt"); !ok || len(p.Attachments) != 1 {
+		t.Error(fmt.Sprintf("should be attached without the path %v", p.Attachments))
+	}
+
+	repo.Protect(p, "alice")
+	if w := upload("notes", token, "bob", "more.txt", "hello"); w.Code != 403 {
+		t.Error(fmt.Sprintf("only admins can attach to protected pages %d", w.Code))
+	}
+	ctx.Auth = NewAuth("X-Remote-User", "alice")
+	if w := upload("notes", token, "alice", "more.txt", "hello"); w.Code != http.StatusFound {
+		t.Error(fmt.Sprintf("admins can attach to protected pages %d", w.Code))
+	}
+	if w := upload("nothing-here", token, "alice", "more.txt", "hello"); w.Code != 404 {
+		t.Error(fmt.Sprintf("can't attach to a page that doesn't exist %d", w.Code))
+	}
+
+	// uploads are served so they can't do anything in the wiki's origin
+	r = httptest.NewRequest("GET", "/attachments/notes/notes.txt", nil)
+	w = httptest.NewRecorder()
+	wikiRoutes(ctx).ServeHTTP(w, r)
+	if w.Code != 200 || w.Body.String() != "hello" {
+		t.Error(fmt.Sprintf("didn't serve the attachment %d %q", w.Code, w.Body.String()))
+	}
+	for header, expected := range map[string]string{
+		"X-Content-Type-Options":  "nosniff",
+		"Content-Security-Policy": "default-src 'none'; style-src 'unsafe-inline'; sandbox",
+		"Content-Disposition":     "attachment; filename*=UTF-8''notes.txt",
+	} {
+		if w.Header().Get(header) != expected {
+			t.Error(fmt.Sprintf("%s should be %q, not %q", header, expected, w.Header().Get(header)))
+		}
+	}
+	r = httptest.NewRequest("GET", "/attachments/notes/missing.txt", nil)
+	w = httptest.NewRecorder()
+	wikiRoutes(ctx).ServeHTTP(w, r)
+	if w.Code != 404 {
+		t.Error(fmt.Sprintf("missing attachment should be a 404 %d", w.Code))
+	}
+}
+
+func TestAttachmentName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"diagram.png":           "diagram.png",
+		"../x":                  "x",
+		"a/b.png":               "b.png",
+		"../../etc/passwd":      "passwd",
+		`C:\Users\me\notes.txt`: "notes.txt",
+		"  spaced.txt ":         "spaced.txt",
+		"..":                    "",
+		"/":                     "",
+		"":                      "",
+	} {
+		if got := attachmentName(name); got != expected {
+			t.Error(fmt.Sprintf("%q should be %q, not %q", name, expected, got))
+		}
+	}
+}
+
+func TestRouter(t *testing.T) {
+	index := NewPageIndex()
+	index.Update(Page{Slug: "team/oncall", Title: "Oncall", Body: "hi"})
+	templates, err := NewTemplates("", false, Site{Name: "gori"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := Context{
+		PageReadRepo: index,
+		Index:        index,
+		Auth:         NewAuth("X-Remote-User", ""),
+		CSRF:         NewCSRF("secret", false),
+		Templates:    templates,
+		Transcluder:  NewTranscluder(index, defaultMaxIncludeDepth),
+	}
+	routes := wikiRoutes(ctx)
+	request := func(method, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+
+	for _, c := range []struct {
+		method, target string
+		status         int
+		location       string
+	}{
+		{"GET", "/page/team/oncall/", 200, ""},
+		{"HEAD", "/page/team/oncall/", 200, ""},
+		{"GET", "/page/team/oncall", 301, "/page/team/oncall/"},
+		{"GET", "/edit/team/oncall?section=1", 301, "/edit/team/oncall/?section=1"},
+		{"GET", "/page//team/./oncall/", 301, "/page/team/oncall/"},
+		{"GET", "/pages", 301, "/pages/"},
+		{"GET", "/page/nothing-here/", 302, "/edit/nothing-here/"},
+		{"GET", "/", 302, "/page/index/"},
+		{"GET", "/tag/", 302, "/tags/"},
+		{"GET", "/protect/team/oncall/", 405, ""},
+		{"GET", "/preview/team/oncall/", 405, ""},
+		{"POST", "/page/team/oncall/", 405, ""},
+		{"GET", "/page/not%20a%20slug/", 400, ""},
+		{"GET", "/nowhere/", 404, ""},
+		{"GET", "/attachments/team/oncall/", 404, ""},
+	} {
+		w := request(c.method, c.target)
+		if w.Code != c.status {
+			t.Error(fmt.Sprintf("%s %s should be %d, not %d", c.method, c.target, c.status, w.Code))
+		}
+		if c.location != "" && w.Header().Get("Location") != c.location {
+			t.Error(fmt.Sprintf("%s %s should go to %s, not %s", c.method, c.target, c.location, w.Header().Get("Location")))
+		}
+	}
+
+	// a 403 for the missing CSRF token, not a 405, means the router let
+	// the POST through. TestProtectedEditing covers the admin checks.
+	w := request("POST", "/protect/team/oncall/")
+	if w.Code != 403 {
+		t.Error(fmt.Sprintf("POST should get through to the handler %d", w.Code))
+	}
+	w = request("GET", "/protect/team/oncall/")
+	if w.Header().Get("Allow") != "POST" {
+		t.Error(fmt.Sprintf("405 should say what is allowed %q", w.Header().Get("Allow")))
+	}
+	w = request("GET", "/nowhere/")
+	if !strings.Contains(w.Body.String(), "<title>Not Found - gori</title>") {
+		t.Error(fmt.Sprintf("errors should use the site layout %s", w.Body.String()))
+	}
+}
+
+// brokenEventStore is a database that's down
+type brokenEventStore struct {
+	memoryEventStore
+}
+
+func (b brokenEventStore) GetEventsFor(id string) (EventList, error) {
+	return nil, fmt.Errorf("connection refused")
+}
+
+func TestEventStoreErrors(t *testing.T) {
+	es := brokenEventStore{memoryEventStore{}}
+	index := NewPageIndex()
+	repo := NewEventStoreRepo(es, index)
+	if _, err := repo.FindBySlug("index"); err == nil {
+		t.Error("FindBySlug should pass on the error")
+	}
+	es.memoryEventStore["index"] = EventList{CreateSetTitleEvent("index", "Index", "")}
+	if err := index.Load(es); err == nil {
+		t.Error("loading the index should fail")
+	}
+
+	templates, err := NewTemplates("", false, Site{Name: "gori"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := Context{
+		PageReadRepo:  repo,
+		PageWriteRepo: repo,
+		EventStore:    es,
+		Index:         index,
+		Auth:          NewAuth("X-Remote-User", ""),
+		CSRF:          NewCSRF("secret", false),
+		Templates:     templates,
+		Drafts:        memoryDraftStore{},
+	}
+	for _, target := range []string{"/page/index/", "/edit/index/", "/history/index/"} {
+		w := httptest.NewRecorder()
+		wikiRoutes(ctx).ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Error(fmt.Sprintf("%s should be a 503 when the database is down, not %d", target, w.Code))
+		}
+	}
+}
+
+// brokenWriteRepo can't save pages
+type brokenWriteRepo struct {
+	memoryWriteRepo
+}
+
+func (b brokenWriteRepo) Save(p *Page, title, body string, tags []string) error {
+	return fmt.Errorf("connection refused")
+}
+
+func TestSaveErrors(t *testing.T) {
+	index := NewPageIndex()
+	index.Update(Page{Slug: "notes", Title: "Notes", Body: "saved body"})
+	templates, err := NewTemplates("", false, Site{Name: "gori"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	drafts := memoryDraftStore{}
+	drafts.Save(Draft{Owner: "session:session", Slug: "notes", Title: "Notes", Body: "half written"})
+	ctx := Context{
+		PageReadRepo:  index,
+		PageWriteRepo: brokenWriteRepo{memoryWriteRepo{index}},
+		Index:         index,
+		Auth:          NewAuth("X-Remote-User", ""),
+		CSRF:          NewCSRF("secret", false),
+		Templates:     templates,
+		Drafts:        drafts,
+	}
+	w := postForm(t, ctx, "/edit/notes/", url.Values{"title": {"Notes"}, "body": {"half written"}})
+	if w.Code != http.StatusServiceUnavailable {
+		t.Error(fmt.Sprintf("a failed save should be a 503, not %d", w.Code))
+	}
+	if d, _ := drafts.Get("session:session", "notes"); d == nil {
+		t.Error("the draft should be kept when the page couldn't be saved")
+	}
+}
+
+func TestUnknownEvents(t *testing.T) {
+	registry := NewPageEventRegistry()
+
+	title, _ := registry.Rehydrate(newUUID(), "set title", 2, "page", `{"title":"A Page"}`, "", time.Now())
+	future, err := registry.Rehydrate(newUUID(), "set colour", 1, "page", "purple", "alice", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if future.GetCommand() != "set colour" || future.GetData() != "purple" || future.GetContext() != "alice" {
+		t.Error(fmt.Sprintf("an unknown event should keep what was stored %v", future))
+	}
+	newer, err := registry.Rehydrate(newUUID(), "set title", 3, "page", `{"heading":"From The Future"}`, "", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, ok := newer.(*UnknownEvent); !ok || u.SchemaVersion != 3 {
+		t.Error(fmt.Sprintf("an event from a newer schema should be kept as it is %v", newer))
+	}
+	p := EventList{title, future, newer}.Apply()
+	if p.Title != "A Page" || p.Version != 3 {
+		t.Error(fmt.Sprintf("unknown events should be skipped over %v", p))
+	}
+	if registry.Dispatch("set colour").GetCommand() != "set colour" {
+		t.Error("Dispatch shouldn't panic on an unknown command")
+	}
+}
+
+func TestUpcasting(t *testing.T) {
+	registry := NewPageEventRegistry()
+	// the way events used to be stored, before they had JSON payloads
+	old := []struct {
+		command string
+		data    string
+	}{
+		{"set title", "Old Page"},
+		{"set body", "some {text} with \"quotes\""},
+		{"set tags", "ops, oncall"},
+		{"protect page", ""},
+		{"redirect", "new-page"},
+	}
+	events := make(EventList, 0)
+	for _, o := range old {
+		e, err := registry.Rehydrate(newUUID(), o.command, 1, "old-page", o.data, "", time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, e)
+	}
+	p := events.Apply()
+	if p.Title != "Old Page" || p.Body != "some {text} with \"quotes\"" ||
+		strings.Join(p.Tags, ",") != "ops,oncall" || !p.Protected || p.RedirectTo != "new-page" {
+		t.Error(fmt.Sprintf("old events weren't upcast properly %v", p))
+	}
+
+	// and new ones come out the same as upcast old ones
+	if CreateSetTitleEvent("p", "Old Page", "").GetData() != events[0].GetData() {
+		t.Error(fmt.Sprintf("new events should be in the current shape %s %s",
+			CreateSetTitleEvent("p", "Old Page", "").GetData(), events[0].GetData()))
+	}
+	if registry.Version("set body") != 2 || registry.Version("attach file") != 1 {
+		t.Error("wrong schema versions")
+	}
+
+	registry.Register("set colour", 3, func() Event { return &UnknownEvent{Command: "set colour"} })
+	registry.Upcaster("set colour", 2, func(data string) (string, error) { return data + "!", nil })
+	if _, err := registry.Upcast("set colour", 1, "purple"); err == nil {
+		t.Error("a gap in the upcasters should be an error")
+	}
+	if data, _ := registry.Upcast("set colour", 2, "purple"); data != "purple!" {
+		t.Error(fmt.Sprintf("upcasters should run up to the current version %q", data))
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// drafts are what someone has typed into the edit form but not saved
+// yet. the form saves them every so often so a closed tab or a crashed
+// browser doesn't lose a long edit. they're kept in their own table,
+// not the event stream, since they aren't part of the page's history
+// and get thrown away once the page is saved.
+
+type Draft struct {
+	Owner string
+	Slug  string
+	Title string
+	Body  string
+	Tags  string
+	// the version of the page the draft was started from
+	Version int
+	Saved   time.Time
+}
+
+type DraftStore interface {
+	// Get returns nil if there isn't a draft
+	Get(owner, slug string) (*Draft, error)
+	Save(Draft) error
+	Discard(owner, slug string) error
+}
+
+type PGDraftStore struct {
+	db *sql.DB
+}
+
+func NewPGDraftStore(dbURL string) *PGDraftStore {
+	db, err := sql.Open("postgres", dbURL)
+	if err != nil {
+		log.Println("can't open database")
+		log.Println(err)
+		os.Exit(1)
+	}
+	return &PGDraftStore{db: db}
+}
+
+func (s PGDraftStore) Get(owner, slug string) (*Draft, error) {
+	d := Draft{Owner: owner, Slug: slug}
+	err := s.db.QueryRow(
+		`select title, body, tags, version, saved
+      from drafts
+     where owner = $1 and slug = $2`, owner, slug).Scan(&d.Title, &d.Body, &d.Tags, &d.Version, &d.Saved)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (s PGDraftStore) Save(d Draft) error {
+	_, err := s.db.Exec(
+		`insert into drafts (owner, slug, title, body, tags, version, saved)
+                  values($1,    $2,   $3,    $4,   $5,   $6,      $7)
+     on conflict (owner, slug)
+     do update set title = $3, body = $4, tags = $5, version = $6, saved = $7`,
+		d.Owner, d.Slug, d.Title, d.Body, d.Tags, d.Version, d.Saved)
+	return err
+}
+
+func (s PGDraftStore) Discard(owner, slug string) error {
+	_, err := s.db.Exec(`delete from drafts where owner = $1 and slug = $2`, owner, slug)
+	return err
+}
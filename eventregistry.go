@@ -1,19 +1,113 @@
 package main
 
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// the registry knows how to turn a stored event back into an Event. each
+// command has a schema version for the shape of its data, and whenever
+// that shape changes, the version goes up and an upcaster gets
+// registered to turn data from the old version into the new one. old
+// events are upcast as they're read, one version at a time, so nothing
+// ever has to rewrite the events table and Apply only has to understand
+// the current shape.
+
 type EventFactory func() Event
 
+// Upcaster turns an event's data from one schema version into the next
+type Upcaster func(string) (string, error)
+
+type eventType struct {
+	factory EventFactory
+	version int
+	// from version -> upcaster to version+1
+	upcasters map[int]Upcaster
+}
+
 type EventRegistry struct {
-	dispatch map[string]EventFactory
+	types map[string]*eventType
 }
 
 func NewEventRegistry() *EventRegistry {
-	return &EventRegistry{dispatch: make(map[string]EventFactory)}
+	return &EventRegistry{types: make(map[string]*eventType)}
+}
+
+// Register adds a command, with the schema version its events are
+// written with now
+func (r *EventRegistry) Register(command string, version int, factory EventFactory) {
+	r.types[command] = &eventType{factory: factory, version: version, upcasters: make(map[int]Upcaster)}
 }
 
+// Upcaster adds the step from schema version from to from+1 for a
+// registered command
+func (r *EventRegistry) Upcaster(command string, from int, upcaster Upcaster) {
+	r.types[command].upcasters[from] = upcaster
+}
+
+// Version is the current schema version for the command, or 0 if it
+// isn't registered
+func (r EventRegistry) Version(command string) int {
+	t, ok := r.types[command]
+	if !ok {
+		return 0
+	}
+	return t.version
+}
+
+// Dispatch makes an empty event for the command, to be hydrated from
+// what was stored. commands that haven't been registered get an
+// UnknownEvent, so a newer event in the database doesn't stop the rest
+// of the page's events from being read.
 func (r EventRegistry) Dispatch(command string) Event {
-	return r.dispatch[command]()
+	t, ok := r.types[command]
+	if !ok {
+		log.Println("unknown event command", command)
+		return &UnknownEvent{Command: command}
+	}
+	return t.factory()
+}
+
+// Upcast brings data stored at the given schema version up to the
+// current one
+func (r EventRegistry) Upcast(command string, version int, data string) (string, error) {
+	t, ok := r.types[command]
+	if !ok {
+		return data, nil
+	}
+	for v := version; v < t.version; v++ {
+		upcaster, ok := t.upcasters[v]
+		if !ok {
+			return "", fmt.Errorf("no way to upcast %q events from version %d", command, v)
+		}
+		var err error
+		data, err = upcaster(data)
+		if err != nil {
+			return "", fmt.Errorf("upcasting %q event from version %d: %v", command, v, err)
+		}
+	}
+	return data, nil
 }
 
-func (r *EventRegistry) Register(command string, factory EventFactory) {
-	r.dispatch[command] = factory
+// Rehydrate turns a row from the event store back into an Event, with
+// its data upcast to the current version. an event written with a
+// newer schema version than this knows about is kept as an
+// UnknownEvent, the same as an unknown command.
+func (r EventRegistry) Rehydrate(uuid, command string, version int, aggregateID, data, context string, created time.Time) (Event, error) {
+	if current := r.Version(command); current == 0 || version > current {
+		if current != 0 {
+			log.Println("event", uuid, "is", command, "version", version, "but only know up to", current)
+		}
+		e := &UnknownEvent{Command: command, SchemaVersion: version}
+		e.Hydrate(uuid, aggregateID, data, context, created)
+		return e, nil
+	}
+	data, err := r.Upcast(command, version, data)
+	if err != nil {
+		return nil, err
+	}
+	e := r.Dispatch(command)
+	e.Hydrate(uuid, aggregateID, data, context, created)
+	return e, nil
 }
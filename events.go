@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"log"
 	"time"
 
 	"github.com/nu7hatch/gouuid"
@@ -28,6 +30,7 @@ func (el EventList) Apply() *Page {
 			p.Created = event.GetCreated()
 		}
 		p = event.Apply(p)
+		p.Version++
 	}
 	return p
 }
@@ -70,20 +73,72 @@ func (e StoredEvent) GetCreated() time.Time {
 	return e.Created
 }
 
+// encode makes an event's JSON payload
+func encode(payload interface{}) string {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Println("can't encode event", err)
+	}
+	return string(data)
+}
+
+// decode reads the event's JSON payload into v
+func (e StoredEvent) decode(v interface{}) bool {
+	if err := json.Unmarshal([]byte(e.Data), v); err != nil {
+		log.Println("bad event data", e.UUID, err)
+		return false
+	}
+	return true
+}
+
 func newUUID() string {
 	u4, _ := uuid.NewV4()
 	return u4.String()
 }
 
+// NewPageEventRegistry registers all the events that make up a page,
+// with their current schema versions and the upcasters from older ones
+func NewPageEventRegistry() *EventRegistry {
+	registry := NewEventRegistry()
+	registry.Register("set title", 2, func() Event { return &SetTitleEvent{} })
+	registry.Upcaster("set title", 1, func(data string) (string, error) {
+		return encode(titlePayload{Title: data}), nil
+	})
+	registry.Register("set body", 2, func() Event { return &SetBodyEvent{} })
+	registry.Upcaster("set body", 1, func(data string) (string, error) {
+		return encode(bodyPayload{Body: data}), nil
+	})
+	registry.Register("set tags", 2, func() Event { return &SetTagsEvent{} })
+	registry.Upcaster("set tags", 1, func(data string) (string, error) {
+		return encode(tagsPayload{Tags: splitList(data)}), nil
+	})
+	registry.Register("protect page", 1, func() Event { return &ProtectPageEvent{} })
+	registry.Register("unprotect page", 1, func() Event { return &UnprotectPageEvent{} })
+	registry.Register("redirect", 2, func() Event { return &RedirectEvent{} })
+	registry.Upcaster("redirect", 1, func(data string) (string, error) {
+		return encode(redirectPayload{To: data}), nil
+	})
+	registry.Register("attach file", 1, func() Event { return &AttachFileEvent{} })
+	return registry
+}
+
 // SetTitleEvent -------------------------------------------------------------
 
+// version 1 data was just the title. now it's
+//
+//	{"title": "Page Title"}
+
 type SetTitleEvent struct {
 	StoredEvent
 }
 
-func CreateSetTitleEvent(aggregateID, data, context string) *SetTitleEvent {
+type titlePayload struct {
+	Title string `json:"title"`
+}
+
+func CreateSetTitleEvent(aggregateID, title, context string) *SetTitleEvent {
 	p := &SetTitleEvent{}
-	p.Hydrate(newUUID(), aggregateID, data, context, time.Now())
+	p.Hydrate(newUUID(), aggregateID, encode(titlePayload{Title: title}), context, time.Now())
 	return p
 }
 
@@ -92,20 +147,32 @@ func (e SetTitleEvent) GetCommand() string {
 }
 
 func (e SetTitleEvent) Apply(page *Page) *Page {
-	page.Title = e.Data
+	var payload titlePayload
+	if !e.decode(&payload) {
+		return page
+	}
+	page.Title = payload.Title
 	page.Modified = e.Created
 	return page
 }
 
 // SetBodyEvent -------------------------------------------------------------
 
+// version 1 data was just the body. now it's
+//
+//	{"body": "..."}
+
 type SetBodyEvent struct {
 	StoredEvent
 }
 
-func CreateSetBodyEvent(aggregateID, data, context string) *SetBodyEvent {
+type bodyPayload struct {
+	Body string `json:"body"`
+}
+
+func CreateSetBodyEvent(aggregateID, body, context string) *SetBodyEvent {
 	p := &SetBodyEvent{}
-	p.Hydrate(newUUID(), aggregateID, data, context, time.Now())
+	p.Hydrate(newUUID(), aggregateID, encode(bodyPayload{Body: body}), context, time.Now())
 	return p
 }
 
@@ -114,7 +181,172 @@ func (e SetBodyEvent) GetCommand() string {
 }
 
 func (e SetBodyEvent) Apply(page *Page) *Page {
-	page.Body = e.Data
+	var payload bodyPayload
+	if !e.decode(&payload) {
+		return page
+	}
+	page.Body = payload.Body
+	page.Meta = metaFor(payload.Body)
+	page.Modified = e.Created
+	return page
+}
+
+// SetTagsEvent -------------------------------------------------------------
+
+// version 1 data was a comma separated list of tags. now it's
+//
+//	{"tags": ["ops", "oncall"]}
+
+type SetTagsEvent struct {
+	StoredEvent
+}
+
+type tagsPayload struct {
+	Tags []string `json:"tags"`
+}
+
+func CreateSetTagsEvent(aggregateID string, tags []string, context string) *SetTagsEvent {
+	p := &SetTagsEvent{}
+	p.Hydrate(newUUID(), aggregateID, encode(tagsPayload{Tags: tags}), context, time.Now())
+	return p
+}
+
+func (e SetTagsEvent) GetCommand() string {
+	return "set tags"
+}
+
+func (e SetTagsEvent) Apply(page *Page) *Page {
+	var payload tagsPayload
+	if !e.decode(&payload) {
+		return page
+	}
+	page.Tags = normalizeTags(payload.Tags)
 	page.Modified = e.Created
 	return page
 }
+
+// ProtectPageEvent ----------------------------------------------------------
+
+type ProtectPageEvent struct {
+	StoredEvent
+}
+
+func CreateProtectPageEvent(aggregateID, data, context string) *ProtectPageEvent {
+	p := &ProtectPageEvent{}
+	p.Hydrate(newUUID(), aggregateID, data, context, time.Now())
+	return p
+}
+
+func (e ProtectPageEvent) GetCommand() string {
+	return "protect page"
+}
+
+func (e ProtectPageEvent) Apply(page *Page) *Page {
+	page.Protected = true
+	return page
+}
+
+// UnprotectPageEvent --------------------------------------------------------
+
+type UnprotectPageEvent struct {
+	StoredEvent
+}
+
+func CreateUnprotectPageEvent(aggregateID, data, context string) *UnprotectPageEvent {
+	p := &UnprotectPageEvent{}
+	p.Hydrate(newUUID(), aggregateID, data, context, time.Now())
+	return p
+}
+
+func (e UnprotectPageEvent) GetCommand() string {
+	return "unprotect page"
+}
+
+func (e UnprotectPageEvent) Apply(page *Page) *Page {
+	page.Protected = false
+	return page
+}
+
+// RedirectEvent -------------------------------------------------------------
+
+// version 1 data was the slug the page has moved to. now it's
+//
+//	{"to": "new-slug"}
+
+type RedirectEvent struct {
+	StoredEvent
+}
+
+type redirectPayload struct {
+	To string `json:"to"`
+}
+
+func CreateRedirectEvent(aggregateID, to, context string) *RedirectEvent {
+	p := &RedirectEvent{}
+	p.Hydrate(newUUID(), aggregateID, encode(redirectPayload{To: to}), context, time.Now())
+	return p
+}
+
+func (e RedirectEvent) GetCommand() string {
+	return "redirect"
+}
+
+func (e RedirectEvent) Apply(page *Page) *Page {
+	var payload redirectPayload
+	if !e.decode(&payload) {
+		return page
+	}
+	page.RedirectTo = payload.To
+	page.Modified = e.Created
+	return page
+}
+
+// AttachFileEvent -----------------------------------------------------------
+
+// Data is the Attachment, JSON encoded
+
+type AttachFileEvent struct {
+	StoredEvent
+}
+
+func CreateAttachFileEvent(aggregateID, data, context string) *AttachFileEvent {
+	p := &AttachFileEvent{}
+	p.Hydrate(newUUID(), aggregateID, data, context, time.Now())
+	return p
+}
+
+func (e AttachFileEvent) GetCommand() string {
+	return "attach file"
+}
+
+func (e AttachFileEvent) Apply(page *Page) *Page {
+	var a Attachment
+	if err := json.Unmarshal([]byte(e.Data), &a); err != nil {
+		log.Println("bad attachment event", e.UUID, err)
+		return page
+	}
+	page.Attach(a)
+	page.Modified = e.Created
+	return page
+}
+
+// UnknownEvent -------------------------------------------------------------
+
+// UnknownEvent stands in for an event with a command this version of
+// gori doesn't know about, like one written by a newer version. it
+// keeps everything that was stored so it can be saved again unchanged
+// (the slug migration copies events, for instance), but doesn't do
+// anything to the page.
+type UnknownEvent struct {
+	StoredEvent
+	Command       string
+	SchemaVersion int
+}
+
+func (e UnknownEvent) GetCommand() string {
+	return e.Command
+}
+
+func (e UnknownEvent) Apply(page *Page) *Page {
+	return page
+}
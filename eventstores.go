@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"log"
 	"os"
 	"time"
@@ -11,7 +12,9 @@ import (
 
 type EventStore interface {
 	Save(string, EventList) error
-	GetEventsFor(string) EventList
+	SaveAtVersion(string, int, EventList) error
+	GetEventsFor(string) (EventList, error)
+	AggregateIDs() ([]string, error)
 	Dispatch(string) Event
 }
 
@@ -28,18 +31,46 @@ func NewPGEventStore(dbURL string) *PGEventStore {
 		log.Println(err)
 		os.Exit(1)
 	}
-	registry := NewEventRegistry()
-	registry.Register("set title", func() Event { return &SetTitleEvent{} })
-	registry.Register("set body", func() Event { return &SetBodyEvent{} })
-
-	return &PGEventStore{db: db, registry: registry}
+	return &PGEventStore{db: db, registry: NewPageEventRegistry()}
 }
 
 func (s PGEventStore) Dispatch(command string) Event {
 	return s.registry.Dispatch(command)
 }
 
+// schemaVersion is the version an event's data is in: the current one
+// for its command, or whatever it was read as if it's one this version
+// of gori doesn't understand
+func (s PGEventStore) schemaVersion(event Event) int {
+	if u, ok := event.(*UnknownEvent); ok && u.SchemaVersion > 0 {
+		return u.SchemaVersion
+	}
+	if version := s.registry.Version(event.GetCommand()); version > 0 {
+		return version
+	}
+	return 1
+}
+
+// errVersionConflict is what SaveAtVersion gives back when someone else
+// saved the aggregate first
+var errVersionConflict = errors.New("saved by someone else in the meantime")
+
 func (s *PGEventStore) Save(aggregateID string, events EventList) error {
+	return s.save(aggregateID, -1, events)
+}
+
+// SaveAtVersion only saves the events if the aggregate still has
+// exactly version events, ie nobody has saved it since it was read.
+// they all go in together or not at all.
+func (s *PGEventStore) SaveAtVersion(aggregateID string, version int, events EventList) error {
+	return s.save(aggregateID, version, events)
+}
+
+// save writes the events in one transaction. saves to the same
+// aggregate take turns (the lock is released when the transaction
+// ends), so checking the version and writing can't be interleaved with
+// another save. a version < 0 isn't checked.
+func (s *PGEventStore) save(aggregateID string, version int, events EventList) error {
 	if len(events) == 0 {
 		// none to save
 		return nil
@@ -49,9 +80,27 @@ func (s *PGEventStore) Save(aggregateID string, events EventList) error {
 		log.Println(err)
 		return err
 	}
+	if _, err := tx.Exec(`select pg_advisory_xact_lock(hashtext($1))`, aggregateID); err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return err
+	}
+	if version >= 0 {
+		var current int
+		err := tx.QueryRow(`select count(*) from events where aggregate_id = $1`, aggregateID).Scan(&current)
+		if err != nil {
+			log.Println(err)
+			tx.Rollback()
+			return err
+		}
+		if current != version {
+			tx.Rollback()
+			return errVersionConflict
+		}
+	}
 	stmt, err := tx.Prepare(
-		`insert into events (id, command, aggregate_id, event_data, event_context)
-                  values($1, $2,      $3,           $4,         $5)`)
+		`insert into events (id, command, aggregate_id, event_data, event_context, created, schema_version)
+                  values($1, $2,      $3,           $4,         $5,            $6,      $7)`)
 	if err != nil {
 		log.Println(err)
 		tx.Rollback()
@@ -65,6 +114,8 @@ func (s *PGEventStore) Save(aggregateID string, events EventList) error {
 			event.GetAggregateID(),
 			event.GetData(),
 			event.GetContext(),
+			event.GetCreated(),
+			s.schemaVersion(event),
 		)
 		if err != nil {
 			log.Println(err)
@@ -75,30 +126,58 @@ func (s *PGEventStore) Save(aggregateID string, events EventList) error {
 	return tx.Commit()
 }
 
-func (s PGEventStore) GetEventsFor(aggregateID string) EventList {
+// GetEventsFor returns all of an aggregate's events, oldest first. if
+// there's an error, there are no events, rather than some of them, so
+// that a database problem never looks like a page with a partial (or
+// no) history.
+func (s PGEventStore) GetEventsFor(aggregateID string) (EventList, error) {
 	events := make(EventList, 0)
 	rows, err := s.db.Query(
-		`select id, command, event_data, event_context, created
+		`select id, command, schema_version, event_data, event_context, created
       from events
      where aggregate_id = $1
      order by created asc`, aggregateID)
 	if err != nil {
-		return events
+		return nil, err
 	}
+	defer rows.Close()
 	var uuid string
 	var command string
+	var version int
 	var data string
 	var context string
 	var created time.Time
 
 	for rows.Next() {
-		err := rows.Scan(&uuid, &command, &data, &context, &created)
+		err := rows.Scan(&uuid, &command, &version, &data, &context, &created)
+		if err != nil {
+			return nil, err
+		}
+		e, err := s.registry.Rehydrate(uuid, command, version, aggregateID, data, context, created)
 		if err != nil {
-			return events
+			return nil, err
 		}
-		e := s.Dispatch(command)
-		e.Hydrate(uuid, aggregateID, data, context, created)
 		events = append(events, e)
 	}
-	return events
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (s PGEventStore) AggregateIDs() ([]string, error) {
+	ids := make([]string, 0)
+	rows, err := s.db.Query(`select distinct aggregate_id from events`)
+	if err != nil {
+		return ids, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// front matter is an optional block of metadata at the very top of a
+// page body. YAML is fenced with "---" lines, TOML with "+++":
+//
+//	---
+//	tags: [ops, oncall]
+//	author: anders
+//	team: infra
+//	---
+//	rest of the page...
+//
+// the fields gori knows about get pulled out into PageMeta, anything
+// else ends up in Custom.
+
+const (
+	yamlFence = "---"
+	tomlFence = "+++"
+)
+
+type PageMeta struct {
+	Tags     []string               `json:"tags,omitempty"`
+	Aliases  []string               `json:"aliases,omitempty"`
+	Author   string                 `json:"author,omitempty"`
+	Renderer string                 `json:"renderer,omitempty"`
+	TOC      string                 `json:"toc,omitempty"`
+	Custom   map[string]interface{} `json:"custom,omitempty"`
+}
+
+// splitFrontMatter returns the raw front matter block, which fence it
+// used, and the rest of the body. if there isn't a (closed) block, the
+// whole body comes back as the rest.
+func splitFrontMatter(body string) (string, string, string) {
+	normalized := strings.Replace(body, "\r\n", "\n", -1)
+	for _, fence := range []string{yamlFence, tomlFence} {
+		if !strings.HasPrefix(normalized, fence+"\n") {
+			continue
+		}
+		lines := strings.Split(normalized, "\n")
+		for idx, line := range lines[1:] {
+			if strings.TrimSpace(line) == fence {
+				block := strings.Join(lines[1:idx+1], "\n")
+				rest := strings.Join(lines[idx+2:], "\n")
+				return block, fence, strings.TrimLeft(rest, "\n")
+			}
+		}
+	}
+	return "", "", body
+}
+
+func parseFrontMatter(body string) (PageMeta, string, error) {
+	meta := PageMeta{}
+	block, fence, rest := splitFrontMatter(body)
+	if fence == "" {
+		return meta, body, nil
+	}
+	fields := make(map[string]interface{})
+	var err error
+	if fence == tomlFence {
+		_, err = toml.Decode(block, &fields)
+	} else {
+		err = yaml.Unmarshal([]byte(block), &fields)
+	}
+	if err != nil {
+		// leave the block in the content so whoever wrote it can see
+		// what's wrong with it
+		return meta, body, err
+	}
+	for key, value := range fields {
+		switch strings.ToLower(key) {
+		case "tags":
+			meta.Tags = stringList(value)
+		case "aliases":
+			meta.Aliases = stringList(value)
+		case "author":
+			meta.Author = fmt.Sprint(value)
+		case "renderer":
+			meta.Renderer = fmt.Sprint(value)
+		case "toc":
+			meta.TOC = fmt.Sprint(value)
+		default:
+			if meta.Custom == nil {
+				meta.Custom = make(map[string]interface{})
+			}
+			meta.Custom[key] = value
+		}
+	}
+	return meta, rest, nil
+}
+
+// stringList accepts either a proper list or a comma separated string,
+// since "tags: a, b" is an easy mistake to make in YAML
+func stringList(value interface{}) []string {
+	items := make([]string, 0)
+	switch v := value.(type) {
+	case []interface{}:
+		for _, item := range v {
+			if s := strings.TrimSpace(fmt.Sprint(item)); s != "" {
+				items = append(items, s)
+			}
+		}
+	case nil:
+	default:
+		items = splitList(fmt.Sprint(v))
+	}
+	return items
+}
+
+func metaFor(body string) PageMeta {
+	meta, _, err := parseFrontMatter(body)
+	if err != nil {
+		log.Println("bad front matter:", err)
+	}
+	return meta
+}
+
+// Content is the body without any front matter
+func (p Page) Content() string {
+	_, content, _ := parseFrontMatter(p.Body)
+	return content
+}
@@ -4,10 +4,12 @@ import (
 	"encoding/json"
 	"expvar"
 	"flag"
+	"html/template"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"time"
 
 	config "github.com/stvp/go-toml-config"
@@ -17,6 +19,15 @@ type Context struct {
 	PageReadRepo  PageReadRepository
 	PageWriteRepo PageWriteRepository
 	EventStore    EventStore
+	Auth          *Auth
+	CSRF          *CSRF
+	Index         *PageIndex
+	Transcluder   *Transcluder
+	Blobs         BlobStore
+	Thumbnails    *Thumbnailer
+	MaxUploadSize int64
+	Templates     *Templates
+	Drafts        DraftStore
 }
 
 var (
@@ -26,17 +37,44 @@ var (
 func main() {
 	var configFile string
 	var loadjson string
+	var migrateslugs bool
 	default_conf_file := "./dev.conf"
 	if os.Getenv("GORI_CONFIG_FILE") != "" {
 		default_conf_file = os.Getenv("GORI_CONFIG_FILE")
 	}
 	flag.StringVar(&configFile, "config", default_conf_file, "TOML config file")
 	flag.StringVar(&loadjson, "loadjson", "", "Load JSON data")
+	flag.BoolVar(&migrateslugs, "migrateslugs", false, "Move pages to their current slugs, leaving redirects")
 	flag.Parse()
 
 	var (
-		port      = config.String("port", "8888")
-		media_dir = config.String("media_dir", "media")
+		port        = config.String("port", "8888")
+		media_dir   = config.String("media_dir", "media")
+		user_header = config.String("user_header", "")
+		admins      = config.String("admins", "")
+		csrf_secret = config.String("csrf_secret", "")
+		secure      = config.Bool("secure_cookies", false)
+
+		sanitize_tags       = config.String("sanitize_tags", defaultAllowedTags)
+		sanitize_attributes = config.String("sanitize_attributes", defaultAllowedAttributes)
+		sanitize_schemes    = config.String("sanitize_url_schemes", defaultURLSchemes)
+		trusted_editors     = config.Bool("trusted_editors", false)
+		default_renderer    = config.String("renderer", "gfm")
+		highlight_theme     = config.String("highlight_theme", "github")
+		line_numbers        = config.Bool("highlight_line_numbers", false)
+		max_include_depth   = config.Int("max_include_depth", defaultMaxIncludeDepth)
+		transliterate       = config.Bool("slug_transliterate", false)
+		attachments_dir     = config.String("attachments_dir", "attachments")
+		max_upload_mb       = config.Int("max_upload_mb", 10)
+		thumbnail_dir       = config.String("thumbnail_dir", "")
+		templates_dir       = config.String("templates_dir", "")
+		template_reload     = config.Bool("template_reload", false)
+		site_name           = config.String("site_name", "gori")
+		site_logo           = config.String("site_logo", "")
+		site_footer         = config.String("site_footer", "")
+		theme_name          = config.String("theme", defaultTheme)
+		custom_css          = config.String("custom_css", "")
+		nav_links           = config.String("nav_links", "")
 	)
 	var DB_URL string
 	config.Parse(configFile)
@@ -46,13 +84,29 @@ func main() {
 	if os.Getenv("GORI_MEDIA_DIR") != "" {
 		*media_dir = os.Getenv("GORI_MEDIA_DIR")
 	}
+	if os.Getenv("GORI_ADMINS") != "" {
+		*admins = os.Getenv("GORI_ADMINS")
+	}
+	if os.Getenv("GORI_CSRF_SECRET") != "" {
+		*csrf_secret = os.Getenv("GORI_CSRF_SECRET")
+	}
+	if os.Getenv("GORI_ATTACHMENTS_DIR") != "" {
+		*attachments_dir = os.Getenv("GORI_ATTACHMENTS_DIR")
+	}
 	if os.Getenv("GORI_DB_URL") != "" {
 		DB_URL = os.Getenv("GORI_DB_URL")
 	}
 
+	transliterateSlugs = *transliterate
+	highlight := HighlightConfig{Theme: *highlight_theme, LineNumbers: *line_numbers}
+	renderers = DefaultRenderers(highlight)
+	renderers.SetDefault(*default_renderer)
+	sanitizer = NewSanitizer(*sanitize_tags, *sanitize_attributes, *sanitize_schemes, *trusted_editors)
+
 	eventStore := NewPGEventStore(DB_URL)
-	readRepo := NewEventStoreRepo(eventStore)
-	writeRepo := NewEventStoreRepo(eventStore)
+	index := NewPageIndex()
+	readRepo := NewEventStoreRepo(eventStore, index)
+	writeRepo := NewEventStoreRepo(eventStore, index)
 
 	if loadjson != "" {
 		log.Println("loading JSON data from", loadjson)
@@ -60,21 +114,103 @@ func main() {
 		os.Exit(0)
 	}
 
-	var ctx = Context{PageReadRepo: readRepo, PageWriteRepo: writeRepo, EventStore: eventStore}
+	if migrateslugs {
+		log.Println("migrating slugs")
+		if err := migrateSlugs(eventStore); err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if err := index.Load(eventStore); err != nil {
+		log.Println("couldn't build the page index")
+		log.Println(err)
+	}
+	canonicalSlug = index.Canonical
+
+	blobs, err := NewLocalBlobStore(*attachments_dir)
+	if err != nil {
+		log.Println("can't use attachments directory")
+		log.Println(err)
+		os.Exit(1)
+	}
+	if *thumbnail_dir == "" {
+		*thumbnail_dir = filepath.Join(*attachments_dir, "thumbnails")
+	}
+	thumbnails, err := NewThumbnailer(blobs, *thumbnail_dir)
+	if err != nil {
+		log.Println("can't use thumbnail directory")
+		log.Println(err)
+		os.Exit(1)
+	}
+
+	theme, err := LoadTheme(*media_dir, *theme_name)
+	if err != nil {
+		log.Println("can't load theme", *theme_name)
+		log.Println(err)
+		os.Exit(1)
+	}
+	site := Site{
+		Name:     *site_name,
+		Logo:     *site_logo,
+		Footer:   template.HTML(*site_footer),
+		Theme:    theme,
+		CSS:      splitList(*custom_css),
+		NavLinks: parseNavLinks(*nav_links),
+	}
+
+	templates, err := NewTemplates(*templates_dir, *template_reload, site)
+	if err != nil {
+		log.Println("can't load templates")
+		log.Println(err)
+		os.Exit(1)
+	}
+
+	var ctx = Context{
+		PageReadRepo:  readRepo,
+		PageWriteRepo: writeRepo,
+		EventStore:    eventStore,
+		Auth:          NewAuth(*user_header, *admins),
+		CSRF:          NewCSRF(*csrf_secret, *secure),
+		Index:         index,
+		Transcluder:   NewTranscluder(readRepo, *max_include_depth),
+		Blobs:         blobs,
+		Thumbnails:    thumbnails,
+		MaxUploadSize: int64(*max_upload_mb) << 20,
+		Templates:     templates,
+		Drafts:        NewPGDraftStore(DB_URL),
+	}
 	http.HandleFunc("/favicon.ico", faviconHandler)
-	http.Handle("/", http.RedirectHandler("/page/index/", 302))
-	http.HandleFunc("/page/", makeHandler(pageHandler, ctx))
-	http.HandleFunc("/edit/", makeHandler(editHandler, ctx))
+	http.HandleFunc("/highlight.css", highlight.CSSHandler())
+	http.Handle("/", wikiRoutes(ctx))
 	http.Handle("/media/", http.StripPrefix("/media/",
 		http.FileServer(http.Dir(*media_dir))))
 	log.Fatal(http.ListenAndServe(":"+*port, nil))
 }
 
-func makeHandler(fn func(http.ResponseWriter, *http.Request, Context),
-	ctx Context) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		reqs.Add(1)
-		fn(w, r, ctx)
+func wikiRoutes(ctx Context) *Router {
+	rt := NewRouter(ctx)
+	rt.Exact("/", redirectHandler("/page/index/"))
+	rt.Page("/page/", pageHandler)
+	rt.Page("/edit/", editHandler, "GET", "POST")
+	rt.Page("/preview/", previewHandler, "POST")
+	rt.Page("/draft/", draftHandler, "POST")
+	rt.Page("/history/", historyHandler)
+	rt.Exact("/pages/", listHandler)
+	rt.Exact("/tag/", redirectHandler("/tags/"))
+	rt.Page("/tag/", tagHandler)
+	rt.Exact("/tags/", tagsHandler)
+	rt.Page("/protect/", protectHandler, "POST")
+	rt.Page("/unprotect/", unprotectHandler, "POST")
+	rt.Page("/attach/", attachHandler, "POST")
+	rt.File("/attachments/", attachmentHandler)
+	return rt
+}
+
+func redirectHandler(to string) Handler {
+	return func(w http.ResponseWriter, r *http.Request, ctx Context, params Params) {
+		http.Redirect(w, r, to, http.StatusFound)
 	}
 }
 
@@ -100,7 +236,11 @@ func loadJSON(readRepo PageReadRepository, writeRepo PageWriteRepository, filena
 	}
 	for title, entry := range entries {
 		slug := slugify(title)
-		p, _ := readRepo.FindBySlug(slug)
+		p, err := readRepo.FindBySlug(slug)
+		if err != nil {
+			log.Println("couldn't load", slug, err)
+			continue
+		}
 		p.Title = entry.Title
 		p.Body = entry.Body
 		modified, err := time.Parse("2006-01-02T15:04:05", entry.Modified)
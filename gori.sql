@@ -15,7 +15,19 @@ CREATE TABLE events (
     aggregate_id text not null,
     created timestamp default current_timestamp,
     event_data text,
-    event_context text
+    event_context text,
+    schema_version integer not null default 1
 );
 
 CREATE INDEX events_aggregate_id_idx on events (aggregate_id);
+
+CREATE TABLE drafts (
+    owner text not null,
+    slug text not null,
+    title text,
+    body text,
+    tags text,
+    version integer not null default 0,
+    saved timestamp,
+    primary key (owner, slug)
+);
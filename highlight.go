@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/yuin/goldmark"
+	highlighting "github.com/yuin/goldmark-highlighting/v2"
+)
+
+// fenced code blocks are highlighted on the server. the markup only has
+// CSS classes on it; the colors come from /highlight.css, which is
+// generated from the configured chroma theme. line numbers can be turned
+// on for every block in the config, or for one block with
+// ```go {linenos=true}
+
+type HighlightConfig struct {
+	Theme       string
+	LineNumbers bool
+}
+
+func DefaultHighlightConfig() HighlightConfig {
+	return HighlightConfig{Theme: "github"}
+}
+
+func (h HighlightConfig) formatOptions() []chromahtml.Option {
+	return []chromahtml.Option{
+		chromahtml.WithClasses(true),
+		chromahtml.WithLineNumbers(h.LineNumbers),
+	}
+}
+
+func (h HighlightConfig) Extension() goldmark.Extender {
+	return highlighting.NewHighlighting(
+		highlighting.WithStyle(h.Theme),
+		highlighting.WithFormatOptions(h.formatOptions()...),
+	)
+}
+
+func (h HighlightConfig) CSSHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/css")
+		formatter := chromahtml.New(h.formatOptions()...)
+		// styles.Get falls back to a default for unknown names
+		formatter.WriteCSS(w, styles.Get(h.Theme))
+	}
+}
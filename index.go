@@ -0,0 +1,268 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// PageIndex is an in-memory projection of the current state of every
+// page. it's built by replaying the event store at startup and kept up
+// to date by EventStoreRepo as events are saved. it's what answers the
+// questions that cut across pages (which pages include this one, etc.)
+// since the event store can only look things up by aggregate.
+
+type PageIndex struct {
+	sync.RWMutex
+	pages map[string]Page
+	// alias slug -> slug of the page that declared it
+	aliases map[string]string
+	// include target -> set of slugs of the pages including it. the
+	// targets are kept as written (resolved relative to the page, but not
+	// through redirects or aliases) since those can change later without
+	// the including page being saved again.
+	includers map[string]map[string]bool
+	// slug -> the include targets it was indexed under, so they can be
+	// taken out again when it's updated
+	includes map[string][]string
+}
+
+func NewPageIndex() *PageIndex {
+	return &PageIndex{
+		pages:     make(map[string]Page),
+		aliases:   make(map[string]string),
+		includers: make(map[string]map[string]bool),
+		includes:  make(map[string][]string),
+	}
+}
+
+func (i *PageIndex) Load(es EventStore) error {
+	ids, err := es.AggregateIDs()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		events, err := es.GetEventsFor(id)
+		if err != nil {
+			return err
+		}
+		i.Update(*events.Apply())
+	}
+	log.Println("indexed", len(ids), "pages")
+	return nil
+}
+
+func (i *PageIndex) Update(p Page) {
+	i.Lock()
+	defer i.Unlock()
+	i.pages[p.Slug] = p
+	i.indexIncludes(p)
+	for alias, slug := range i.aliases {
+		if slug == p.Slug {
+			delete(i.aliases, alias)
+		}
+	}
+	if p.RedirectTo != "" {
+		return
+	}
+	for _, alias := range p.Meta.Aliases {
+		alias = slugify(alias)
+		if alias == "" || alias == p.Slug {
+			continue
+		}
+		if other, ok := i.aliases[alias]; ok && other != p.Slug {
+			log.Println("alias", alias, "is claimed by both", other, "and", p.Slug)
+		}
+		i.aliases[alias] = p.Slug
+	}
+}
+
+func (i *PageIndex) indexIncludes(p Page) {
+	for _, target := range i.includes[p.Slug] {
+		delete(i.includers[target], p.Slug)
+		if len(i.includers[target]) == 0 {
+			delete(i.includers, target)
+		}
+	}
+	targets := p.includesVia(func(slug string) string { return slug })
+	for _, target := range targets {
+		if i.includers[target] == nil {
+			i.includers[target] = make(map[string]bool)
+		}
+		i.includers[target][p.Slug] = true
+	}
+	i.includes[p.Slug] = targets
+}
+
+// Canonical returns the slug of the page that should be shown for slug,
+// following redirects and aliases. a real page always wins over an
+// alias with the same slug.
+func (i *PageIndex) Canonical(slug string) string {
+	i.RLock()
+	defer i.RUnlock()
+	return i.canonicalLocked(slug)
+}
+
+// canonicalLocked is Canonical for when the lock is already held. taking
+// the read lock again there can deadlock if an Update is waiting for it.
+func (i *PageIndex) canonicalLocked(slug string) string {
+	// a redirect could point at another redirect; don't go around forever
+	for hops := 0; hops < 5; hops++ {
+		p, ok := i.pages[slug]
+		if ok && p.RedirectTo != "" {
+			slug = p.RedirectTo
+			continue
+		}
+		if ok && p.Exists() {
+			return slug
+		}
+		if target, ok := i.aliases[slug]; ok {
+			slug = target
+			continue
+		}
+		return slug
+	}
+	return slug
+}
+
+// FindBySlug lets the index stand in as a PageReadRepository.
+func (i *PageIndex) FindBySlug(slug string) (*Page, error) {
+	i.RLock()
+	defer i.RUnlock()
+	p, ok := i.pages[slug]
+	if !ok {
+		return &Page{Slug: slug}, nil
+	}
+	return &p, nil
+}
+
+// IncludedBy returns the slugs of the pages that transclude the given one
+func (i *PageIndex) IncludedBy(slug string) []string {
+	i.RLock()
+	defer i.RUnlock()
+	found := make(map[string]bool)
+	for target, includers := range i.includers {
+		if i.canonicalLocked(target) != slug {
+			continue
+		}
+		for s := range includers {
+			found[s] = true
+		}
+	}
+	slugs := make([]string, 0, len(found))
+	for s := range found {
+		slugs = append(slugs, s)
+	}
+	sort.Strings(slugs)
+	return slugs
+}
+
+// Subpages returns every page below slug in the hierarchy, sorted by slug
+func (i *PageIndex) Subpages(slug string) []Page {
+	i.RLock()
+	defer i.RUnlock()
+	prefix := slug + "/"
+	pages := make([]Page, 0)
+	for s, p := range i.pages {
+		if strings.HasPrefix(s, prefix) && p.Exists() {
+			pages = append(pages, p)
+		}
+	}
+	sort.Slice(pages, func(a, b int) bool {
+		return pages[a].Slug < pages[b].Slug
+	})
+	return pages
+}
+
+// PageFilter narrows down a listing. empty fields match everything.
+// Fields are matched against the custom front matter fields.
+type PageFilter struct {
+	Query  string
+	Tag    string
+	Author string
+	Fields map[string]string
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f PageFilter) Matches(p Page) bool {
+	if !p.Exists() {
+		return false
+	}
+	if f.Query != "" {
+		q := strings.ToLower(f.Query)
+		if !strings.Contains(strings.ToLower(p.Title), q) &&
+			!strings.Contains(strings.ToLower(p.Body), q) {
+			return false
+		}
+	}
+	if f.Tag != "" && !containsFold(p.AllTags(), f.Tag) {
+		return false
+	}
+	if f.Author != "" && !strings.EqualFold(p.Meta.Author, f.Author) {
+		return false
+	}
+	for key, want := range f.Fields {
+		value, ok := p.Meta.Custom[key]
+		if !ok {
+			return false
+		}
+		if !containsFold(stringList(value), want) {
+			return false
+		}
+	}
+	return true
+}
+
+// Find returns the pages that match the filter, sorted by title
+func (i *PageIndex) Find(f PageFilter) []Page {
+	i.RLock()
+	defer i.RUnlock()
+	pages := make([]Page, 0)
+	for _, p := range i.pages {
+		if f.Matches(p) {
+			pages = append(pages, p)
+		}
+	}
+	sort.Slice(pages, func(a, b int) bool {
+		return pages[a].Title < pages[b].Title
+	})
+	return pages
+}
+
+type TagCount struct {
+	Tag   string
+	Count int
+}
+
+// TagCounts returns every tag in use and how many pages have it,
+// sorted by tag
+func (i *PageIndex) TagCounts() []TagCount {
+	i.RLock()
+	defer i.RUnlock()
+	counts := make(map[string]int)
+	for _, p := range i.pages {
+		if !p.Exists() {
+			continue
+		}
+		for _, tag := range p.AllTags() {
+			counts[tag]++
+		}
+	}
+	tags := make([]TagCount, 0, len(counts))
+	for tag, count := range counts {
+		tags = append(tags, TagCount{Tag: tag, Count: count})
+	}
+	sort.Slice(tags, func(a, b int) bool {
+		return tags[a].Tag < tags[b].Tag
+	})
+	return tags
+}
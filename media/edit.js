@@ -0,0 +1,113 @@
+// write/preview tabs for the edit form. the preview is rendered by the
+// server, so links, includes and attachments come out the same as they
+// will on the page. without javascript it's just the textarea.
+(function () {
+  var form = document.getElementById("edit-form");
+  if (!form || !window.fetch || !window.FormData) {
+    return;
+  }
+  var tabs = form.querySelector(".edit-tabs");
+  var body = form.querySelector("textarea[name=body]");
+  var preview = form.querySelector(".edit-preview");
+  tabs.hidden = false;
+
+  function activate(link) {
+    var items = tabs.querySelectorAll("li");
+    for (var i = 0; i < items.length; i++) {
+      items[i].className = "";
+    }
+    link.parentNode.className = "active";
+  }
+
+  function showPreview(link) {
+    preview.innerHTML = "<p class=\"muted\">rendering...</p>";
+    preview.style.minHeight = body.offsetHeight + "px";
+    body.hidden = true;
+    preview.hidden = false;
+    fetch(link.getAttribute("data-url"), {
+      method: "POST",
+      body: new FormData(form),
+      credentials: "same-origin"
+    }).then(function (response) {
+      if (!response.ok) {
+        throw new Error(response.status + " " + response.statusText);
+      }
+      return response.text();
+    }).then(function (html) {
+      preview.innerHTML = html;
+    }).catch(function (err) {
+      preview.innerHTML = "";
+      var p = document.createElement("p");
+      p.className = "include-error";
+      p.textContent = "couldn't render the preview: " + err.message;
+      preview.appendChild(p);
+    });
+  }
+
+  tabs.addEventListener("click", function (e) {
+    var link = e.target.closest("a[data-tab]");
+    if (!link) {
+      return;
+    }
+    e.preventDefault();
+    activate(link);
+    if (link.getAttribute("data-tab") === "preview") {
+      showPreview(link);
+    } else {
+      preview.hidden = true;
+      body.hidden = false;
+      body.focus();
+    }
+  });
+})();
+
+// autosave. while the form has unsaved changes, it gets posted as a
+// draft every so often (and when the page is closed), and the server
+// offers it back next time the form is opened.
+(function () {
+  var form = document.getElementById("edit-form");
+  if (!form || !window.fetch || !window.FormData) {
+    return;
+  }
+  var url = form.getAttribute("data-draft-url");
+  if (!url) {
+    // editing a single section, which doesn't get drafts
+    return;
+  }
+  var status = form.querySelector(".draft-status");
+  var dirty = false;
+  var submitting = false;
+
+  function save() {
+    if (!dirty || submitting) {
+      return;
+    }
+    dirty = false;
+    fetch(url, {
+      method: "POST",
+      body: new FormData(form),
+      credentials: "same-origin"
+    }).then(function (response) {
+      if (!response.ok) {
+        throw new Error(response.status + " " + response.statusText);
+      }
+      status.textContent = "draft saved " + new Date().toLocaleTimeString();
+    }).catch(function (err) {
+      dirty = true;
+      status.textContent = "couldn't save draft: " + err.message;
+    });
+  }
+
+  form.addEventListener("input", function () {
+    dirty = true;
+  });
+  form.addEventListener("submit", function () {
+    submitting = true;
+  });
+  setInterval(save, 15000);
+  window.addEventListener("pagehide", function () {
+    if (dirty && !submitting && navigator.sendBeacon) {
+      navigator.sendBeacon(url, new FormData(form));
+    }
+  });
+})();
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"strings"
+)
+
+// when two people edit the same page at once, the second one to save
+// would normally just overwrite the first. instead, the edit form
+// remembers which version of the page it started from (the base), and
+// on save the changes from base to what's saved now and from base to
+// what was submitted get merged line by line, like diff3. if they
+// touched different lines it just goes through. if they changed the
+// same lines, the editor gets the form back with both versions marked.
+
+const (
+	conflictStart = "<<<<<<< your changes\n"
+	conflictSep   = "=======\n"
+	conflictEnd   = ">>>>>>> saved version\n"
+)
+
+// lines are matched up with Myers' diff, which takes time for each line
+// that's different rather than for every pair of lines. past this many
+// differences between two stretches of lines it stops looking for more
+// lines in common between them, so that can't take forever. a stretch
+// that's had that many lines changed comes out as one chunk.
+const maxMergeEdits = 5000
+
+// mergeLines splits s into lines, each keeping its newline. only the
+// last one can be missing it.
+func mergeLines(s string) []string {
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	if s == "" {
+		return []string{}
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// lcsMatches returns, for each line of a, the index of the line in b
+// it's matched up with in a longest common subsequence, or -1
+func lcsMatches(a, b []string) []int {
+	// comparing numbers is quicker than comparing lines
+	ids := make(map[string]int)
+	intern := func(lines []string) []int {
+		out := make([]int, len(lines))
+		for i, line := range lines {
+			id, ok := ids[line]
+			if !ok {
+				id = len(ids)
+				ids[line] = id
+			}
+			out[i] = id
+		}
+		return out
+	}
+	d := differ{a: intern(a), b: intern(b), matches: make([]int, len(a))}
+	for i := range d.matches {
+		d.matches[i] = -1
+	}
+	d.diff(0, len(a), 0, len(b))
+	return d.matches
+}
+
+type differ struct {
+	a, b    []int
+	matches []int
+}
+
+// diff matches up the lines of a[aLo:aHi] with b[bLo:bHi]
+func (d *differ) diff(aLo, aHi, bLo, bHi int) {
+	// lines that are the same at the start and end don't need the
+	// expensive part
+	for aLo < aHi && bLo < bHi && d.a[aLo] == d.b[bLo] {
+		d.matches[aLo] = bLo
+		aLo, bLo = aLo+1, bLo+1
+	}
+	for aLo < aHi && bLo < bHi && d.a[aHi-1] == d.b[bHi-1] {
+		aHi, bHi = aHi-1, bHi-1
+		d.matches[aHi] = bHi
+	}
+	if aLo == aHi || bLo == bHi {
+		return
+	}
+	x, y, ok := d.split(aLo, aHi, bLo, bHi)
+	if !ok {
+		return
+	}
+	d.diff(aLo, x, bLo, y)
+	d.diff(x, aHi, y, bHi)
+}
+
+// split finds a point that a shortest edit script from a[aLo:aHi] to
+// b[bLo:bHi] goes through, by following the script forwards from the
+// start and backwards from the end at the same time until they meet.
+// it only needs memory for the diagonals, not the whole edit graph.
+// ok is false if it's further than maxMergeEdits.
+func (d *differ) split(aLo, aHi, bLo, bHi int) (x, y int, ok bool) {
+	n, m := aHi-aLo, bHi-bLo
+	maxD := (n + m + 1) / 2
+	if maxD > maxMergeEdits {
+		maxD = maxMergeEdits
+	}
+	// forward[offset+k] is how far along a the forward search has got
+	// on diagonal k (where x-y = k), backward the same counting from
+	// the end
+	offset := maxD + 1
+	forward := make([]int, 2*offset+1)
+	backward := make([]int, 2*offset+1)
+	for i := range forward {
+		forward[i], backward[i] = -1, -1
+	}
+	forward[offset+1], backward[offset+1] = 0, 0
+	delta := n - m
+	// with an odd delta the searches meet going forwards, even,
+	// backwards
+	odd := delta%2 != 0
+	// diagonals that have run off the edge of the graph aren't
+	// searched again
+	fStart, fEnd, bStart, bEnd := 0, 0, 0, 0
+	for e := 0; e < maxD; e++ {
+		for k := -e + fStart; k <= e-fEnd; k += 2 {
+			var fx int
+			if k == -e || (k != e && forward[offset+k-1] < forward[offset+k+1]) {
+				fx = forward[offset+k+1]
+			} else {
+				fx = forward[offset+k-1] + 1
+			}
+			fy := fx - k
+			for fx < n && fy < m && d.a[aLo+fx] == d.b[bLo+fy] {
+				fx, fy = fx+1, fy+1
+			}
+			forward[offset+k] = fx
+			if fx > n {
+				fEnd += 2
+			} else if fy > m {
+				fStart += 2
+			} else if odd {
+				bk := offset + delta - k
+				if bk >= 0 && bk < len(backward) && backward[bk] != -1 && fx >= n-backward[bk] {
+					return aLo + fx, bLo + fy, true
+				}
+			}
+		}
+		for k := -e + bStart; k <= e-bEnd; k += 2 {
+			var bx int
+			if k == -e || (k != e && backward[offset+k-1] < backward[offset+k+1]) {
+				bx = backward[offset+k+1]
+			} else {
+				bx = backward[offset+k-1] + 1
+			}
+			by := bx - k
+			for bx < n && by < m && d.a[aHi-1-bx] == d.b[bHi-1-by] {
+				bx, by = bx+1, by+1
+			}
+			backward[offset+k] = bx
+			if bx > n {
+				bEnd += 2
+			} else if by > m {
+				bStart += 2
+			} else if !odd {
+				fk := offset + delta - k
+				if fk >= 0 && fk < len(forward) && forward[fk] != -1 {
+					fx := forward[fk]
+					fy := fx - (fk - offset)
+					if fx >= n-bx {
+						return aLo + fx, bLo + fy, true
+					}
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+func sameLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func withNewline(lines []string) []string {
+	if len(lines) > 0 && !strings.HasSuffix(lines[len(lines)-1], "\n") {
+		lines = append(append([]string{}, lines[:len(lines)-1]...), lines[len(lines)-1]+"\n")
+	}
+	return lines
+}
+
+// merge3 merges mine and theirs, which were both edited from base. it
+// returns the merged text and whether it went through cleanly. if it
+// didn't, the conflicting parts are in the text between markers.
+func merge3(base, theirs, mine string) (string, bool) {
+	o, a, b := mergeLines(base), mergeLines(mine), mergeLines(theirs)
+	matchA, matchB := lcsMatches(o, a), lcsMatches(o, b)
+
+	out := make([]string, 0, len(a)+len(b))
+	clean := true
+	io, ia, ib := 0, 0, 0
+	for io < len(o) || ia < len(a) || ib < len(b) {
+		// a line nobody changed
+		if io < len(o) && matchA[io] == ia && matchB[io] == ib {
+			out = append(out, o[io])
+			io, ia, ib = io+1, ia+1, ib+1
+			continue
+		}
+		// otherwise, everything up to the next line that's still in
+		// both is a chunk that at least one of them changed
+		next := io
+		for next < len(o) && (matchA[next] < 0 || matchB[next] < 0) {
+			next++
+		}
+		endA, endB := len(a), len(b)
+		if next < len(o) {
+			endA, endB = matchA[next], matchB[next]
+		}
+		co, ca, cb := o[io:next], a[ia:endA], b[ib:endB]
+		switch {
+		case sameLines(co, ca):
+			out = append(out, cb...)
+		case sameLines(co, cb), sameLines(ca, cb):
+			out = append(out, ca...)
+		default:
+			clean = false
+			out = append(out, conflictStart)
+			out = append(out, withNewline(ca)...)
+			out = append(out, conflictSep)
+			out = append(out, withNewline(cb)...)
+			out = append(out, conflictEnd)
+		}
+		io, ia, ib = next, endA, endB
+	}
+	return strings.Join(out, ""), clean
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// pages in the template/ namespace (or, from before there were
+// namespaces, titled "Template:Something") are templates for new pages. when
+// someone creates a page from one, its body is copied into the edit form
+// with {{title}}, {{slug}}, {{date}}, {{time}} and {{author}} filled in.
+// anything else in double braces (like {{include: ...}}) is left alone.
+
+var templatePrefixes = []string{"template/", "template:"}
+
+var templateVarPattern = regexp.MustCompile(`\{\{\s*([a-z]+)\s*\}\}`)
+
+func isTemplateSlug(slug string) bool {
+	for _, prefix := range templatePrefixes {
+		if strings.HasPrefix(slug, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func templateVars(title, slug, author string, now time.Time) map[string]string {
+	return map[string]string{
+		"title":  title,
+		"slug":   slug,
+		"date":   now.Format("2006-01-02"),
+		"time":   now.Format("15:04"),
+		"author": author,
+	}
+}
+
+func applyTemplate(body string, vars map[string]string) string {
+	return templateVarPattern.ReplaceAllStringFunc(body, func(m string) string {
+		name := templateVarPattern.FindStringSubmatch(m)[1]
+		if value, ok := vars[name]; ok {
+			return value
+		}
+		return m
+	})
+}
+
+// Templates returns all the template pages, sorted by title
+func (i *PageIndex) Templates() []Page {
+	i.RLock()
+	defer i.RUnlock()
+	templates := make([]Page, 0)
+	for slug, p := range i.pages {
+		if isTemplateSlug(slug) && p.Exists() {
+			templates = append(templates, p)
+		}
+	}
+	sort.Slice(templates, func(a, b int) bool {
+		return templates[a].Title < templates[b].Title
+	})
+	return templates
+}
@@ -36,7 +36,7 @@ func (r *PGRepo) FindBySlug(slug string) (*Page, error) {
 	if row == nil {
 		// if it's not in the database, we make a blank one
 		now := time.Now()
-		return &Page{slug, "", "", now, now}, nil
+		return &Page{Slug: slug, Created: now, Modified: now}, nil
 	}
 	var title string
 	var body string
@@ -45,7 +45,7 @@ func (r *PGRepo) FindBySlug(slug string) (*Page, error) {
 
 	row.Scan(&title, &body, &created, &modified)
 
-	p := Page{slug, title, body, created, modified}
+	p := Page{Slug: slug, Title: title, Body: body, Created: created, Modified: modified, Meta: metaFor(body)}
 	return &p, nil
 }
 
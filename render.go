@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"log"
+
+	"github.com/russross/blackfriday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer/html"
+)
+
+// Renderer turns markdown (after wiki links have been expanded) into
+// HTML. output still goes through the sanitizer afterwards, so renderers
+// are free to pass raw HTML through.
+type Renderer interface {
+	Render([]byte) []byte
+}
+
+type RendererRegistry struct {
+	renderers   map[string]Renderer
+	defaultName string
+}
+
+func NewRendererRegistry(defaultName string) *RendererRegistry {
+	return &RendererRegistry{
+		renderers:   make(map[string]Renderer),
+		defaultName: defaultName,
+	}
+}
+
+func (r *RendererRegistry) Register(name string, renderer Renderer) {
+	r.renderers[name] = renderer
+}
+
+// Get returns the named renderer, or the default one if the name is
+// empty or unknown.
+func (r RendererRegistry) Get(name string) Renderer {
+	if renderer, ok := r.renderers[name]; ok {
+		return renderer
+	}
+	if name != "" {
+		log.Println("unknown renderer", name, "using", r.defaultName)
+	}
+	return r.renderers[r.defaultName]
+}
+
+func (r *RendererRegistry) SetDefault(name string) {
+	if _, ok := r.renderers[name]; !ok {
+		log.Println("unknown renderer", name, "keeping", r.defaultName)
+		return
+	}
+	r.defaultName = name
+}
+
+// GFMRenderer ---------------------------------------------------------------
+
+// CommonMark plus the GitHub extensions (tables, task lists,
+// strikethrough, autolinks), footnotes and heading anchors. headings can
+// be given an explicit anchor with "## Heading {#some-id}". fenced code
+// blocks get syntax highlighting.
+type GFMRenderer struct {
+	md goldmark.Markdown
+}
+
+func NewGFMRenderer(h HighlightConfig) *GFMRenderer {
+	md := goldmark.New(
+		goldmark.WithExtensions(
+			// extension.GFM, except that table column alignment is done
+			// with align attributes, since the sanitizer drops styles
+			extension.NewTable(extension.WithTableCellAlignMethod(extension.TableCellAlignAttribute)),
+			extension.Strikethrough,
+			extension.Linkify,
+			extension.TaskList,
+			extension.Footnote,
+			h.Extension(),
+		),
+		goldmark.WithParserOptions(parser.WithAutoHeadingID(), parser.WithAttribute()),
+		goldmark.WithRendererOptions(html.WithUnsafe()),
+	)
+	return &GFMRenderer{md: md}
+}
+
+func (r GFMRenderer) Render(source []byte) []byte {
+	var buf bytes.Buffer
+	if err := r.md.Convert(source, &buf); err != nil {
+		log.Println(err)
+	}
+	return buf.Bytes()
+}
+
+// BlackfridayRenderer -------------------------------------------------------
+
+// what gori always used before. kept around for pages that depend on
+// its quirks.
+type BlackfridayRenderer struct{}
+
+func (r BlackfridayRenderer) Render(source []byte) []byte {
+	// MarkdownCommon, plus generated heading ids for the table of contents
+	htmlFlags := blackfriday.HTML_USE_XHTML |
+		blackfriday.HTML_USE_SMARTYPANTS |
+		blackfriday.HTML_SMARTYPANTS_FRACTIONS |
+		blackfriday.HTML_SMARTYPANTS_DASHES |
+		blackfriday.HTML_SMARTYPANTS_LATEX_DASHES
+	renderer := blackfriday.HtmlRenderer(htmlFlags, "", "")
+	extensions := blackfriday.EXTENSION_NO_INTRA_EMPHASIS |
+		blackfriday.EXTENSION_TABLES |
+		blackfriday.EXTENSION_FENCED_CODE |
+		blackfriday.EXTENSION_AUTOLINK |
+		blackfriday.EXTENSION_STRIKETHROUGH |
+		blackfriday.EXTENSION_SPACE_HEADERS |
+		blackfriday.EXTENSION_HEADER_IDS |
+		blackfriday.EXTENSION_BACKSLASH_LINE_BREAK |
+		blackfriday.EXTENSION_DEFINITION_LISTS |
+		blackfriday.EXTENSION_AUTO_HEADER_IDS
+	return blackfriday.Markdown(source, renderer, extensions)
+}
+
+func DefaultRenderers(h HighlightConfig) *RendererRegistry {
+	registry := NewRendererRegistry("gfm")
+	registry.Register("gfm", NewGFMRenderer(h))
+	registry.Register("blackfriday", BlackfridayRenderer{})
+	return registry
+}
+
+// configured from main()
+var renderers = DefaultRenderers(DefaultHighlightConfig())
@@ -1,21 +1,50 @@
 package main
 
 import (
+	"encoding/json"
 	"log"
 )
 
 // EventStore -----------------------------------------------------
 
 type EventStoreRepo struct {
-	es EventStore
+	es    EventStore
+	index *PageIndex
 }
 
-func NewEventStoreRepo(e EventStore) *EventStoreRepo {
-	return &EventStoreRepo{es: e}
+func NewEventStoreRepo(e EventStore, index *PageIndex) *EventStoreRepo {
+	return &EventStoreRepo{es: e, index: index}
+}
+
+// save writes the events and, if that worked, updates the index with
+// the page's new state
+func (er *EventStoreRepo) save(page *Page, events EventList) error {
+	return er.saveAt(page, -1, events)
+}
+
+// saveAt is save, but only if nobody else has saved the page since it
+// was at version. a version < 0 saves regardless.
+func (er *EventStoreRepo) saveAt(page *Page, version int, events EventList) error {
+	var err error
+	if version < 0 {
+		err = er.es.Save(page.Slug, events)
+	} else {
+		err = er.es.SaveAtVersion(page.Slug, version, events)
+	}
+	if err == nil {
+		page.Version += len(events)
+	}
+	if err == nil && len(events) > 0 && er.index != nil {
+		er.index.Update(*page)
+	}
+	return err
 }
 
 func (er *EventStoreRepo) FindBySlug(slug string) (*Page, error) {
-	events := er.es.GetEventsFor(slug)
+	events, err := er.es.GetEventsFor(slug)
+	if err != nil {
+		return nil, err
+	}
 	log.Println("events:", len(events))
 	for _, event := range events {
 		log.Println("\t", event.GetCommand(), event.GetAggregateID())
@@ -29,7 +58,7 @@ func (er *EventStoreRepo) SetTitle(page *Page, title string) error {
 	if page.SetTitle(title) {
 		events = append(events, CreateSetTitleEvent(page.Slug, page.Title, ""))
 	}
-	return er.es.Save(page.Slug, events)
+	return er.save(page, events)
 }
 
 func (er *EventStoreRepo) SetBody(page *Page, body string) error {
@@ -37,5 +66,59 @@ func (er *EventStoreRepo) SetBody(page *Page, body string) error {
 	if page.SetBody(body) {
 		events = append(events, CreateSetBodyEvent(page.Slug, page.Body, ""))
 	}
-	return er.es.Save(page.Slug, events)
+	return er.save(page, events)
+}
+
+func (er *EventStoreRepo) SetTags(page *Page, tags []string) error {
+	events := make(EventList, 0)
+	if page.SetTags(tags) {
+		events = append(events, CreateSetTagsEvent(page.Slug, page.Tags, ""))
+	}
+	return er.save(page, events)
+}
+
+func (er *EventStoreRepo) Save(page *Page, title, body string, tags []string) error {
+	version := page.Version
+	events := make(EventList, 0)
+	if page.SetTitle(title) {
+		events = append(events, CreateSetTitleEvent(page.Slug, page.Title, ""))
+	}
+	if page.SetBody(body) {
+		events = append(events, CreateSetBodyEvent(page.Slug, page.Body, ""))
+	}
+	if page.SetTags(tags) {
+		events = append(events, CreateSetTagsEvent(page.Slug, page.Tags, ""))
+	}
+	return er.saveAt(page, version, events)
+}
+
+func (er *EventStoreRepo) Attach(page *Page, a Attachment, user string) error {
+	events := make(EventList, 0)
+	if page.Attach(a) {
+		data, err := json.Marshal(a)
+		if err != nil {
+			return err
+		}
+		events = append(events, CreateAttachFileEvent(page.Slug, string(data), user))
+	}
+	return er.save(page, events)
+}
+
+// Protect and Unprotect record the acting user as the event context so
+// that the change shows up in the page history.
+
+func (er *EventStoreRepo) Protect(page *Page, user string) error {
+	events := make(EventList, 0)
+	if page.SetProtected(true) {
+		events = append(events, CreateProtectPageEvent(page.Slug, "", user))
+	}
+	return er.save(page, events)
+}
+
+func (er *EventStoreRepo) Unprotect(page *Page, user string) error {
+	events := make(EventList, 0)
+	if page.SetProtected(false) {
+		events = append(events, CreateUnprotectPageEvent(page.Slug, "", user))
+	}
+	return er.save(page, events)
 }
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"unicode"
+)
+
+// the router matches a request to a handler and pulls the slug (and for
+// attachments, the file name) out of the path, so handlers don't have to
+// pick apart URLs themselves. it also takes care of the things every
+// handler would otherwise need to get right on its own: only allowing
+// the right methods, sending /page/foo to /page/foo/, and showing the
+// same error page for anything that's not found or not allowed.
+
+// Params are the parts of the path a route picked out
+type Params struct {
+	Slug string
+	Name string
+}
+
+type Handler func(http.ResponseWriter, *http.Request, Context, Params)
+
+type pathKind int
+
+const (
+	// just the prefix itself, like /pages/
+	exactPath pathKind = iota
+	// the prefix then a slug, like /page/team/oncall/
+	slugPath
+	// the prefix, a slug and a file name, like /attachments/team/oncall/diagram.png
+	filePath
+)
+
+type route struct {
+	prefix  string
+	kind    pathKind
+	methods []string
+	handler Handler
+}
+
+type Router struct {
+	ctx    Context
+	routes []route
+}
+
+func NewRouter(ctx Context) *Router {
+	return &Router{ctx: ctx}
+}
+
+func (rt *Router) add(prefix string, kind pathKind, handler Handler, methods []string) {
+	if len(methods) == 0 {
+		methods = []string{"GET"}
+	}
+	rt.routes = append(rt.routes, route{prefix: prefix, kind: kind, methods: methods, handler: handler})
+}
+
+// Exact routes just the one path. methods default to GET.
+func (rt *Router) Exact(path string, handler Handler, methods ...string) {
+	rt.add(path, exactPath, handler, methods)
+}
+
+// Page routes prefix/<slug>/
+func (rt *Router) Page(prefix string, handler Handler, methods ...string) {
+	rt.add(prefix, slugPath, handler, methods)
+}
+
+// File routes prefix/<slug>/<name>
+func (rt *Router) File(prefix string, handler Handler, methods ...string) {
+	rt.add(prefix, filePath, handler, methods)
+}
+
+// validSlug is whether something from a path could be a slug at all
+func validSlug(slug string) bool {
+	if slug == "" {
+		return false
+	}
+	for _, r := range slug {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r route) allows(method string) bool {
+	for _, m := range r.methods {
+		if m == method || (m == "GET" && method == "HEAD") {
+			return true
+		}
+	}
+	return false
+}
+
+func redirectTo(w http.ResponseWriter, r *http.Request, p string) {
+	if r.URL.RawQuery != "" {
+		p += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, p, http.StatusMovedPermanently)
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reqs.Add(1)
+	p := r.URL.Path
+	// tidy up things like /page//foo/ or /page/./foo
+	if cleaned := path.Clean(p); cleaned != p && cleaned+"/" != p {
+		if strings.HasSuffix(p, "/") && cleaned != "/" {
+			cleaned += "/"
+		}
+		redirectTo(w, r, cleaned)
+		return
+	}
+
+	for _, route := range rt.routes {
+		var params Params
+		switch route.kind {
+		case exactPath:
+			if p != route.prefix {
+				if p+"/" == route.prefix {
+					redirectTo(w, r, route.prefix)
+					return
+				}
+				continue
+			}
+		case slugPath:
+			if !strings.HasPrefix(p, route.prefix) || p == route.prefix {
+				continue
+			}
+			if !strings.HasSuffix(p, "/") {
+				redirectTo(w, r, p+"/")
+				return
+			}
+			params.Slug = strings.TrimSuffix(p[len(route.prefix):], "/")
+		case filePath:
+			if !strings.HasPrefix(p, route.prefix) {
+				continue
+			}
+			rest := p[len(route.prefix):]
+			idx := strings.LastIndex(rest, "/")
+			if idx < 1 || idx == len(rest)-1 {
+				errorPage(w, rt.ctx, http.StatusNotFound, "")
+				return
+			}
+			params.Slug, params.Name = rest[:idx], rest[idx+1:]
+		}
+		if route.kind != exactPath && !validSlug(params.Slug) {
+			errorPage(w, rt.ctx, http.StatusBadRequest, "that isn't a valid page name")
+			return
+		}
+		if !route.allows(r.Method) {
+			w.Header().Set("Allow", strings.Join(route.methods, ", "))
+			errorPage(w, rt.ctx, http.StatusMethodNotAllowed, "")
+			return
+		}
+		route.handler(w, r, rt.ctx, params)
+		return
+	}
+	errorPage(w, rt.ctx, http.StatusNotFound, "")
+}
+
+type ErrorResponse struct {
+	Status  int
+	Title   string
+	Message string
+}
+
+// errorPage shows an error in the site's layout. message can be left
+// empty for the standard one for the status.
+func errorPage(w http.ResponseWriter, ctx Context, status int, message string) {
+	if message == "" {
+		message = defaultErrorMessages[status]
+	}
+	if ctx.Templates == nil {
+		http.Error(w, message, status)
+		return
+	}
+	if status >= 500 {
+		log.Println("error page", status, message)
+	}
+	ctx.Templates.RenderStatus(w, status, "error.html", ErrorResponse{
+		Status:  status,
+		Title:   http.StatusText(status),
+		Message: message,
+	})
+}
+
+var defaultErrorMessages = map[int]string{
+	http.StatusBadRequest:       "that request didn't make sense",
+	http.StatusNotFound:         "there's nothing here",
+	http.StatusMethodNotAllowed: "that can't be done here. if you followed a link or reloaded a form, go back and try again",
+}
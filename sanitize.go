@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// rendered markdown goes through an allowlist before it's sent to a
+// browser, so raw <script>, event handler attributes, javascript: links,
+// etc. in a page body don't run for everyone who reads it.
+
+const (
+	defaultAllowedTags = "p,br,hr,h1,h2,h3,h4,h5,h6,blockquote,pre,code," +
+		"em,strong,b,i,del,s,sup,sub,kbd,abbr,ul,ol,li,dl,dt,dd,a,img," +
+		"table,thead,tbody,tfoot,tr,th,td,div,span,input"
+	// (input is only there for task list checkboxes.) attributes are
+	// either a bare name (allowed on any tag) or tag:attribute
+	defaultAllowedAttributes = "id,class,title,a:href,img:src,img:alt," +
+		"img:width,img:height,th:align,td:align,abbr:title," +
+		"input:type,input:checked,input:disabled"
+	defaultURLSchemes = "http,https,mailto"
+)
+
+type Sanitizer struct {
+	policy *bluemonday.Policy
+	// trusted skips sanitization entirely. only for wikis where
+	// everyone who can edit is trusted to put arbitrary HTML on pages
+	trusted bool
+}
+
+func splitList(s string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func NewSanitizer(tags, attributes, schemes string, trusted bool) *Sanitizer {
+	p := bluemonday.NewPolicy()
+	p.AllowElements(splitList(tags)...)
+	for _, attr := range splitList(attributes) {
+		if strings.Contains(attr, ":") {
+			parts := strings.SplitN(attr, ":", 2)
+			p.AllowAttrs(parts[1]).OnElements(parts[0])
+		} else {
+			p.AllowAttrs(attr).Globally()
+		}
+	}
+	p.AllowURLSchemes(splitList(schemes)...)
+	p.AllowRelativeURLs(true)
+	p.RequireParseableURLs(true)
+	return &Sanitizer{policy: p, trusted: trusted}
+}
+
+func DefaultSanitizer() *Sanitizer {
+	return NewSanitizer(defaultAllowedTags, defaultAllowedAttributes, defaultURLSchemes, false)
+}
+
+func (s *Sanitizer) Sanitize(html []byte) []byte {
+	if s.trusted {
+		return html
+	}
+	return s.policy.SanitizeBytes(html)
+}
+
+// configured from main()
+var sanitizer = DefaultSanitizer()
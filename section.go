@@ -0,0 +1,113 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// sections let someone edit one part of a big page instead of the whole
+// thing. they're numbered the way MediaWiki does it: section 0 is
+// everything before the first heading, then each "#" style heading
+// starts the next one. a section runs until the next heading at the
+// same level or higher, so it includes its subsections. front matter
+// isn't in any section, and neither are headings inside code blocks.
+
+type Section struct {
+	Number int
+	Level  int
+	Title  string
+	// lines of the body it covers, [start, end)
+	start int
+	end   int
+}
+
+var markdownHeadingPattern = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+
+func isFence(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~")
+}
+
+// splitSections returns the body's lines (with their line endings) and
+// its sections, section 0 first
+func splitSections(body string) ([]string, []Section) {
+	lines := strings.SplitAfter(body, "\n")
+	first := 0
+	if len(lines) > 0 {
+		fence := strings.TrimSpace(lines[0])
+		if fence == yamlFence || fence == tomlFence {
+			for i := 1; i < len(lines); i++ {
+				if strings.TrimSpace(lines[i]) == fence {
+					first = i + 1
+					break
+				}
+			}
+		}
+	}
+
+	sections := []Section{{Number: 0, start: first, end: len(lines)}}
+	inCode := false
+	for i := first; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], "\r\n")
+		if isFence(line) {
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			continue
+		}
+		m := markdownHeadingPattern.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		sections = append(sections, Section{
+			Number: len(sections),
+			Level:  len(m[1]),
+			Title:  strings.TrimSpace(m[2]),
+			start:  i,
+			end:    len(lines),
+		})
+	}
+	if len(sections) > 1 {
+		sections[0].end = sections[1].start
+	}
+	for i := 1; i < len(sections); i++ {
+		for _, next := range sections[i+1:] {
+			if next.Level <= sections[i].Level {
+				sections[i].end = next.start
+				break
+			}
+		}
+	}
+	return lines, sections
+}
+
+// Sections is the page's headings, for picking one to edit
+func (p Page) Sections() []Section {
+	_, sections := splitSections(p.Body)
+	return sections[1:]
+}
+
+func getSection(body string, n int) (string, bool) {
+	lines, sections := splitSections(body)
+	if n < 0 || n >= len(sections) {
+		return "", false
+	}
+	s := sections[n]
+	return strings.Join(lines[s.start:s.end], ""), true
+}
+
+// replaceSection swaps section n of the body for text
+func replaceSection(body string, n int, text string) (string, bool) {
+	lines, sections := splitSections(body)
+	if n < 0 || n >= len(sections) {
+		return "", false
+	}
+	s := sections[n]
+	rest := strings.Join(lines[s.end:], "")
+	if rest != "" && text != "" && !strings.HasSuffix(text, "\n") {
+		// keep the next heading on a line of its own
+		text += "\n"
+	}
+	return strings.Join(lines[:s.start], "") + text + rest, true
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// slugs keep letters and digits from any script (normalized, so the
+// same title typed on two different machines gets the same slug) and
+// turn everything else into dashes. a few characters that would
+// otherwise just disappear ("C#" would be the same page as "C") are
+// spelled out instead. they're spelled as the plain word, so "C#" and
+// "C sharp" are the same page, the same as "on-call" and "on call".
+
+var (
+	slugReplacements = map[rune]string{
+		'#': "sharp",
+		'+': "plus",
+		'&': "and",
+		'@': "at",
+		'%': "percent",
+	}
+	// letters that don't decompose into an ASCII letter plus accents
+	transliterations = map[rune]string{
+		'ß': "ss", 'æ': "ae", 'œ': "oe", 'ø': "o", 'ł': "l",
+		'đ': "d", 'ð': "d", 'þ': "th", 'ı': "i",
+	}
+	dashes = regexp.MustCompile(`-+`)
+
+	// when set, accented latin letters are reduced to plain ASCII
+	// ("Café" is cafe rather than café). configured from main()
+	transliterateSlugs = false
+)
+
+func transliterate(s string) string {
+	t := transform.Chain(norm.NFKD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	stripped, _, err := transform.String(t, s)
+	if err != nil {
+		return s
+	}
+	var b strings.Builder
+	for _, r := range stripped {
+		if replacement, ok := transliterations[r]; ok {
+			b.WriteString(replacement)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func slugifySegment(s string) string {
+	s = strings.ToLower(norm.NFKC.String(s))
+	if transliterateSlugs {
+		s = transliterate(s)
+	}
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r), unicode.IsMark(r):
+			b.WriteRune(r)
+		case r == '_' || r == '.' || r == ':':
+			// safe in a url path and worth keeping (template:foo, v1.2)
+			b.WriteRune(r)
+		case slugReplacements[r] != "":
+			b.WriteString("-" + slugReplacements[r] + "-")
+		default:
+			b.WriteRune('-')
+		}
+	}
+	return strings.Trim(dashes.ReplaceAllString(b.String(), "-"), "-")
+}
+
+// slugify works on each /-separated part of a title separately, so
+// "Team / On Call" is team/on-call
+func slugify(s string) string {
+	segments := make([]string, 0)
+	for _, segment := range strings.Split(s, "/") {
+		segment = slugifySegment(segment)
+		if segment == "" || segment == "." || segment == ".." {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	return strings.Join(segments, "/")
+}
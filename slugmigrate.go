@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+)
+
+// migrateSlugs moves every page whose slug isn't what slugify makes of
+// it now (eg, from before slugs were normalized, or after turning on
+// transliteration) to its new slug. the page's events are copied over
+// with their original times, so the history comes along, and a redirect
+// is left behind at the old slug so existing links and bookmarks still
+// work. pages whose new slug is already taken, or that would end up
+// with the same new slug as another page, are left alone and reported.
+func migrateSlugs(es EventStore) error {
+	ids, err := es.AggregateIDs()
+	if err != nil {
+		return err
+	}
+	// new slug -> old slugs moving there
+	moves := make(map[string][]string)
+	for _, oldSlug := range ids {
+		newSlug := slugify(oldSlug)
+		if newSlug == oldSlug || newSlug == "" {
+			continue
+		}
+		events, err := es.GetEventsFor(oldSlug)
+		if err != nil {
+			return err
+		}
+		if events.Apply().RedirectTo != "" {
+			// already moved
+			continue
+		}
+		moves[newSlug] = append(moves[newSlug], oldSlug)
+	}
+	newSlugs := make([]string, 0, len(moves))
+	for newSlug := range moves {
+		newSlugs = append(newSlugs, newSlug)
+	}
+	sort.Strings(newSlugs)
+
+	for _, newSlug := range newSlugs {
+		if len(moves[newSlug]) > 1 {
+			// whichever came first shouldn't just win. someone has to
+			// pick, and rename or merge the others by hand
+			sort.Strings(moves[newSlug])
+			log.Println("can't move", strings.Join(moves[newSlug], ", "), "because they'd all end up at", newSlug)
+			continue
+		}
+		oldSlug := moves[newSlug][0]
+		events, err := es.GetEventsFor(oldSlug)
+		if err != nil {
+			return err
+		}
+		existing, err := es.GetEventsFor(newSlug)
+		if err != nil {
+			return err
+		}
+		if len(existing) > 0 {
+			log.Println("can't move", oldSlug, "to", newSlug, "because there's already a page there")
+			continue
+		}
+		copies := make(EventList, 0, len(events))
+		for _, event := range events {
+			c := es.Dispatch(event.GetCommand())
+			if u, ok := event.(*UnknownEvent); ok {
+				// keep it exactly as it was, whatever it is
+				c = &UnknownEvent{Command: u.Command, SchemaVersion: u.SchemaVersion}
+			}
+			c.Hydrate(newUUID(), newSlug, event.GetData(), event.GetContext(), event.GetCreated())
+			copies = append(copies, c)
+		}
+		if err := es.Save(newSlug, copies); err != nil {
+			return err
+		}
+		redirect := CreateRedirectEvent(oldSlug, newSlug, "slug migration")
+		if err := es.Save(oldSlug, EventList{redirect}); err != nil {
+			return err
+		}
+		log.Println("moved", oldSlug, "to", newSlug)
+	}
+	return nil
+}
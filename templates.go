@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+)
+
+// the HTML templates live in templates/ and are compiled into the
+// binary. any of them can be overridden by putting a file with the same
+// name in the directory set by templates_dir.
+//
+// base.html is the layout. each page template defines "title" and
+// "content" (and optionally "head"), and files starting with _ are
+// partials shared by all of them.
+
+//go:embed templates/*.html
+var embeddedTemplates embed.FS
+
+// pages are the templates that can be rendered
+var pages = []string{"view.html", "edit.html", "history.html", "list.html", "tags.html", "error.html"}
+
+// overlayFS looks for a file in the override directory first and falls
+// back to the embedded copy
+type overlayFS struct {
+	dir      string
+	fallback fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	if o.dir != "" {
+		if f, err := os.DirFS(o.dir).Open(name); err == nil {
+			return f, nil
+		}
+	}
+	return o.fallback.Open(name)
+}
+
+func (o overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	seen := make(map[string]bool)
+	entries := make([]fs.DirEntry, 0)
+	if o.dir != "" {
+		if local, err := fs.ReadDir(os.DirFS(o.dir), name); err == nil {
+			for _, e := range local {
+				seen[e.Name()] = true
+				entries = append(entries, e)
+			}
+		}
+	}
+	embedded, err := fs.ReadDir(o.fallback, name)
+	if err != nil {
+		return entries, err
+	}
+	for _, e := range embedded {
+		if !seen[e.Name()] {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+type Templates struct {
+	sync.RWMutex
+	fsys   fs.FS
+	reload bool
+	funcs  template.FuncMap
+	set    map[string]*template.Template
+}
+
+// NewTemplates parses everything up front so a broken template is found
+// at startup. with reload on (for working on the templates), they're
+// parsed again on every request instead.
+func NewTemplates(dir string, reload bool, site Site) (*Templates, error) {
+	embedded, err := fs.Sub(embeddedTemplates, "templates")
+	if err != nil {
+		return nil, err
+	}
+	t := &Templates{
+		fsys:   overlayFS{dir: dir, fallback: embedded},
+		reload: reload,
+		funcs: template.FuncMap{
+			"site": func() Site { return site },
+		},
+	}
+	set, err := t.parse()
+	if err != nil {
+		return nil, err
+	}
+	t.set = set
+	return t, nil
+}
+
+func (t *Templates) parse() (map[string]*template.Template, error) {
+	set := make(map[string]*template.Template)
+	for _, name := range pages {
+		tmpl, err := template.New("base.html").Funcs(t.funcs).ParseFS(t.fsys, "base.html", "_*.html", name)
+		if err != nil {
+			return nil, err
+		}
+		set[name] = tmpl
+	}
+	return set, nil
+}
+
+func (t *Templates) get(name string) (*template.Template, error) {
+	if t.reload {
+		set, err := t.parse()
+		if err != nil {
+			return nil, err
+		}
+		t.Lock()
+		t.set = set
+		t.Unlock()
+	}
+	t.RLock()
+	defer t.RUnlock()
+	tmpl, ok := t.set[name]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return tmpl, nil
+}
+
+// Render executes the named page template into a buffer first, so that
+// if anything goes wrong the user gets an error page rather than half a
+// page.
+func (t *Templates) Render(w http.ResponseWriter, name string, data interface{}) {
+	t.RenderStatus(w, http.StatusOK, name, data)
+}
+
+func (t *Templates) RenderStatus(w http.ResponseWriter, status int, name string, data interface{}) {
+	tmpl, err := t.get(path.Base(name))
+	if err != nil {
+		log.Println("template", name, err)
+		http.Error(w, "error loading template", 500)
+		return
+	}
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, "base", data); err != nil {
+		log.Println("template", name, err)
+		http.Error(w, "error rendering page", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
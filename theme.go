@@ -0,0 +1,91 @@
+package main
+
+import (
+	"html/template"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// a theme is a directory under media/themes/ with a theme.toml saying
+// which stylesheets and scripts to put on every page:
+//
+//	stylesheets = ["/media/bootstrap/css/bootstrap.css", "theme.css"]
+//	scripts = ["/media/js/jquery-1.7.2.min.js"]
+//
+// paths that aren't absolute are relative to the theme's directory, so a
+// theme can bring its own files or use ones from elsewhere in media.
+
+const defaultTheme = "bootstrap"
+
+type Theme struct {
+	Name        string
+	Stylesheets []string `toml:"stylesheets"`
+	Scripts     []string `toml:"scripts"`
+}
+
+func LoadTheme(mediaDir, name string) (Theme, error) {
+	theme := Theme{Name: name}
+	file := filepath.Join(mediaDir, "themes", name, "theme.toml")
+	if _, err := toml.DecodeFile(file, &theme); err != nil {
+		return theme, err
+	}
+	theme.Stylesheets = theme.resolve(theme.Stylesheets)
+	theme.Scripts = theme.resolve(theme.Scripts)
+	return theme, nil
+}
+
+func (t Theme) resolve(paths []string) []string {
+	resolved := make([]string, 0, len(paths))
+	for _, p := range paths {
+		if strings.HasPrefix(p, "/") || strings.Contains(p, "://") {
+			resolved = append(resolved, p)
+		} else {
+			resolved = append(resolved, path.Join("/media/themes", t.Name, p))
+		}
+	}
+	return resolved
+}
+
+type NavLink struct {
+	Label string
+	URL   string
+}
+
+// parseNavLinks reads the nav_links setting, a comma separated list of
+// "label|url", like "about|/page/about/, source|https://github.com/thraxil/gori"
+func parseNavLinks(s string) []NavLink {
+	links := make([]NavLink, 0)
+	for _, item := range splitList(s) {
+		parts := strings.SplitN(item, "|", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		label, url := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if label == "" || url == "" {
+			continue
+		}
+		links = append(links, NavLink{Label: label, URL: url})
+	}
+	return links
+}
+
+// Site is everything about the look of the wiki that isn't in the
+// templates themselves. the templates get it from the "site" function.
+type Site struct {
+	Name     string
+	Logo     string
+	Footer   template.HTML
+	Theme    Theme
+	CSS      []string
+	NavLinks []NavLink
+}
+
+// Stylesheets is gori's own css, then the theme's, then any custom css,
+// so each can override the ones before it
+func (s Site) Stylesheets() []string {
+	sheets := append([]string{"/media/main.css"}, s.Theme.Stylesheets...)
+	return append(sheets, s.CSS...)
+}
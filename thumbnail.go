@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/image/draw"
+)
+
+// thumbnails of image attachments are made the first time they're asked
+// for and kept on disk after that. they're named for the blob hash and
+// the size they come out at (not the size asked for, so asking for every
+// size up to the limit doesn't make a file for each one), so a new
+// version of an attachment gets new thumbnails and old ones can just be
+// deleted whenever.
+
+const maxThumbnailSize = 2000
+
+// images with more pixels than this aren't thumbnailed, since the whole
+// thing has to be decoded into memory first. a small file can claim to
+// be an enormous image.
+const maxThumbnailPixels = 50 * 1000 * 1000
+
+var errNotThumbnailable = errors.New("can't make thumbnails of that")
+
+type Thumbnailer struct {
+	blobs BlobStore
+	dir   string
+}
+
+func NewThumbnailer(blobs BlobStore, dir string) (*Thumbnailer, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Thumbnailer{blobs: blobs, dir: dir}, nil
+}
+
+func thumbnailFormat(contentType string) string {
+	switch contentType {
+	case "image/png":
+		return "png"
+	case "image/jpeg":
+		return "jpeg"
+	case "image/gif":
+		return "gif"
+	}
+	return ""
+}
+
+// thumbnailSize fits the image inside width x height (either of which
+// can be 0 for "don't care"), keeping the aspect ratio. images are never
+// made bigger.
+func thumbnailSize(bounds image.Rectangle, width, height int) (int, int) {
+	w, h := bounds.Dx(), bounds.Dy()
+	if w == 0 || h == 0 {
+		return w, h
+	}
+	if width <= 0 || width > w {
+		width = w
+	}
+	if height <= 0 || height > h {
+		height = h
+	}
+	// scale by whichever side needs to shrink more
+	if width*h < height*w {
+		height = h * width / w
+	} else {
+		width = w * height / h
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	return width, height
+}
+
+// Thumbnail returns the path of a thumbnail of the attachment that fits
+// in width x height, making it if it isn't already there
+func (t *Thumbnailer) Thumbnail(a Attachment, width, height int) (string, error) {
+	format := thumbnailFormat(a.ContentType)
+	if format == "" || !validHash(a.Hash) {
+		return "", errNotThumbnailable
+	}
+	if width > maxThumbnailSize || height > maxThumbnailSize || width < 0 || height < 0 {
+		return "", fmt.Errorf("thumbnails can be at most %dx%d", maxThumbnailSize, maxThumbnailSize)
+	}
+
+	blob, err := t.blobs.Open(a.Hash)
+	if err != nil {
+		return "", err
+	}
+	defer blob.Close()
+	// just the header, to find out how big it is before decoding it
+	config, _, err := image.DecodeConfig(blob)
+	if err != nil {
+		return "", err
+	}
+	if int64(config.Width)*int64(config.Height) > maxThumbnailPixels {
+		return "", errNotThumbnailable
+	}
+	w, h := thumbnailSize(image.Rect(0, 0, config.Width, config.Height), width, height)
+	path := filepath.Join(t.dir, fmt.Sprintf("%s-%dx%d.%s", a.Hash, w, h, format))
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	if _, err := blob.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	src, _, err := image.Decode(blob)
+	if err != nil {
+		return "", err
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Over, nil)
+
+	tmp, err := ioutil.TempFile(t.dir, "thumb-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	switch format {
+	case "png":
+		err = png.Encode(tmp, dst)
+	case "jpeg":
+		err = jpeg.Encode(tmp, dst, &jpeg.Options{Quality: 85})
+	case "gif":
+		// only the first frame of an animated gif
+		err = gif.Encode(tmp, dst, nil)
+	}
+	tmp.Close()
+	if err != nil {
+		return "", err
+	}
+	return path, os.Rename(tmp.Name(), path)
+}
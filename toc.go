@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// a table of contents is built from the headings in the rendered HTML,
+// so it works with any renderer that puts ids on its headings. ids come
+// from the heading text (or an explicit {#id} after the heading), not
+// its position, so links to a section keep working when other sections
+// are added or moved around.
+
+const tocMarker = "[[toc]]"
+
+var (
+	headingPattern = regexp.MustCompile(`(?s)<h([1-6])[^>]*\sid="([^"]+)"[^>]*>(.*?)</h[1-6]>`)
+	tagPattern     = regexp.MustCompile(`<[^>]*>`)
+)
+
+func isTOCMarker(s string) bool {
+	s = strings.Replace(s, " ", "", -1)
+	return strings.EqualFold(s, tocMarker)
+}
+
+type TOCEntry struct {
+	Level int
+	ID    string
+	Text  string
+}
+
+func extractTOC(rendered []byte) []TOCEntry {
+	entries := make([]TOCEntry, 0)
+	for _, m := range headingPattern.FindAllSubmatch(rendered, -1) {
+		text := html.UnescapeString(string(tagPattern.ReplaceAll(m[3], nil)))
+		entries = append(entries, TOCEntry{
+			Level: int(m[1][0] - '0'),
+			ID:    html.UnescapeString(string(m[2])),
+			Text:  strings.TrimSpace(text),
+		})
+	}
+	return entries
+}
+
+// renderTOC makes nested lists out of the entries. a page that starts
+// at h2 or skips a level still nests sensibly because levels are only
+// compared to each other.
+func renderTOC(entries []TOCEntry) string {
+	if len(entries) == 0 {
+		return ""
+	}
+	var buf bytes.Buffer
+	buf.WriteString(`<nav class="toc">`)
+	levels := make([]int, 0)
+	for _, e := range entries {
+		for len(levels) > 0 && e.Level < levels[len(levels)-1] {
+			buf.WriteString("</li></ul>")
+			levels = levels[:len(levels)-1]
+		}
+		if len(levels) == 0 || e.Level > levels[len(levels)-1] {
+			buf.WriteString("<ul>")
+			levels = append(levels, e.Level)
+		} else {
+			buf.WriteString("</li>")
+		}
+		fmt.Fprintf(&buf, `<li><a href="#%s">%s</a>`,
+			html.EscapeString(e.ID), html.EscapeString(e.Text))
+	}
+	for range levels {
+		buf.WriteString("</li></ul>")
+	}
+	buf.WriteString("</nav>")
+	return buf.String()
+}
+
+// insertTOC replaces the [[toc]] marker paragraph with the table of
+// contents. this runs after sanitization since the sanitizer doesn't
+// know about <nav> and everything in the TOC is escaped here anyway.
+func insertTOC(rendered []byte) []byte {
+	marker := []byte("<p>" + tocMarker + "</p>")
+	if !bytes.Contains(rendered, marker) {
+		return rendered
+	}
+	toc := renderTOC(extractTOC(rendered))
+	return bytes.Replace(rendered, marker, []byte(toc), -1)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"html/template"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// a line in a page body that looks like
+//
+//	{{include: Some Page}}
+//
+// gets replaced with the rendered body of that page. includes are
+// expanded after the including page has been rendered and sanitized
+// (the included page's body has been sanitized on its own), so each page
+// keeps its own renderer and front matter.
+
+const defaultMaxIncludeDepth = 5
+
+var (
+	includeSourcePattern   = regexp.MustCompile(`(?m)^\s*\{\{\s*include:\s*([^}]+?)\s*\}\}\s*$`)
+	includeRenderedPattern = regexp.MustCompile(`<p>\{\{\s*include:\s*([^}]+?)\s*\}\}</p>`)
+)
+
+// Includes returns the slugs of the pages this one transcludes
+func (p Page) Includes() []string {
+	return p.includesVia(canonicalSlug)
+}
+
+// includesVia is Includes with canonical standing in for canonicalSlug,
+// for the index to use while it already holds its lock
+func (p Page) includesVia(canonical func(string) string) []string {
+	slugs := make([]string, 0)
+	for _, m := range includeSourcePattern.FindAllStringSubmatch(p.Content(), -1) {
+		slugs = append(slugs, canonical(resolveLink(m[1], p.Slug)))
+	}
+	return slugs
+}
+
+type Transcluder struct {
+	repo     PageReadRepository
+	maxDepth int
+}
+
+func NewTranscluder(repo PageReadRepository, maxDepth int) *Transcluder {
+	return &Transcluder{repo: repo, maxDepth: maxDepth}
+}
+
+// Render is RenderedBody with includes expanded
+func (t Transcluder) Render(p *Page) template.HTML {
+	return template.HTML(string(t.expand(p, []string{p.Slug})))
+}
+
+func (t Transcluder) expand(p *Page, stack []string) []byte {
+	rendered := []byte(string(p.RenderedBody()))
+	return includeRenderedPattern.ReplaceAllFunc(rendered, func(m []byte) []byte {
+		title := html.UnescapeString(string(includeRenderedPattern.FindSubmatch(m)[1]))
+		return t.include(title, stack)
+	})
+}
+
+func (t Transcluder) include(title string, stack []string) []byte {
+	slug := linkTarget(title, stack[len(stack)-1])
+	if onStack(stack, slug) {
+		return includeError("recursive include of", title, slug)
+	}
+	if len(stack) > t.maxDepth {
+		return includeError("includes nested too deeply at", title, slug)
+	}
+	included, err := t.repo.FindBySlug(slug)
+	if err == nil && included.RedirectTo != "" {
+		slug = included.RedirectTo
+		// the redirect can point back at a page that's already being
+		// included
+		if onStack(stack, slug) {
+			return includeError("recursive include of", title, slug)
+		}
+		included, err = t.repo.FindBySlug(slug)
+	}
+	if err != nil {
+		log.Println(err)
+		return includeError("couldn't load", title, slug)
+	}
+	if !included.Exists() {
+		return includeError("no page called", title, slug)
+	}
+	included.Slug = slug
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<div class="include" data-page="%s">`, html.EscapeString(slug))
+	next := append(append([]string{}, stack...), slug)
+	buf.Write(t.expand(included, next))
+	buf.WriteString("</div>")
+	return buf.Bytes()
+}
+
+func onStack(stack []string, slug string) bool {
+	for _, s := range stack {
+		if s == slug {
+			return true
+		}
+	}
+	return false
+}
+
+func includeError(msg, title, slug string) []byte {
+	return []byte(fmt.Sprintf(`<p class="include-error">%s <a href="/page/%s/">%s</a></p>`,
+		html.EscapeString(msg), html.EscapeString(slug), html.EscapeString(strings.TrimSpace(title))))
+}
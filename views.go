@@ -2,187 +2,694 @@ package main
 
 import (
 	"html/template"
+	"io"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// when pages can't be read (the database is down, say), that has to be
+// an error rather than looking like the page doesn't exist, which would
+// send people to the edit form to write over it
+const unavailableMessage = "the page couldn't be loaded right now. try again in a minute"
+
+// how many times a save is merged with someone else's and tried again
+// before giving up
+const maxSaveAttempts = 3
+
+type Breadcrumb struct {
+	Title string
+	Slug  string
+}
+
+func breadcrumbs(slug string, repo PageReadRepository) []Breadcrumb {
+	crumbs := make([]Breadcrumb, 0)
+	for _, parent := range parentSlugs(slug) {
+		title := deslug(parent)
+		if p, err := repo.FindBySlug(parent); err == nil && p.Title != "" {
+			title = p.Title
+		}
+		crumbs = append(crumbs, Breadcrumb{Title: title, Slug: parent})
+	}
+	return crumbs
+}
+
 type PageResponse struct {
-	Title    string
-	Slug     string
-	Body     template.HTML
-	Modified string
+	Title       string
+	Slug        string
+	Body        template.HTML
+	Modified    string
+	Protected   bool
+	TOC         template.HTML
+	IncludedBy  []string
+	Tags        []string
+	Crumbs      []Breadcrumb
+	Subpages    []Page
+	Attachments []Attachment
 }
 
-func pageHandler(w http.ResponseWriter, r *http.Request, ctx Context) {
+func pageHandler(w http.ResponseWriter, r *http.Request, ctx Context, params Params) {
 	log.Println("pageHandler", r.URL.String())
-	parts := strings.Split(r.URL.String(), "/")
-	if len(parts) < 3 {
-		http.Error(w, "bad request", 400)
-		return
-	}
-	slug := parts[2]
-	if slug == "" {
-		http.Error(w, "bad request", 400)
-		return
-	}
+	slug := params.Slug
 	page, err := ctx.PageReadRepo.FindBySlug(slug)
 	if err != nil {
 		log.Println(err)
-		http.Error(w, "error retrieving page", 500)
+		errorPage(w, ctx, http.StatusServiceUnavailable, unavailableMessage)
+		return
+	}
+	if page.RedirectTo != "" {
+		http.Redirect(w, r, "/page/"+page.RedirectTo+"/", http.StatusMovedPermanently)
 		return
 	}
 	if page.Title == "" {
+		if canonical := ctx.Index.Canonical(slug); canonical != slug {
+			// an alias for another page
+			http.Redirect(w, r, "/page/"+canonical+"/", http.StatusMovedPermanently)
+			return
+		}
 		http.Redirect(w, r, "/edit/"+slug+"/", http.StatusFound)
 		return
 	}
-	w.Header().Set("Content-Type", "text/html")
+	page.Slug = slug
+	body := ctx.Transcluder.Render(page)
 	pr := PageResponse{
-		Title:    page.Title,
-		Slug:     slugify(page.Title),
-		Body:     page.RenderedBody(),
-		Modified: page.RenderModified(),
-	}
-	t, _ := template.New("page").Parse(page_view_template)
-	t.Execute(w, pr)
-}
-
-const page_view_template = `
-<!DOCTYPE html>
-<html lang="en">
-<head>
-<meta charset="utf-8" />
-<title>{{.Title}}</title>
- <meta name="viewport" content="width=device-width, initial-scale=1.0">
-  <meta name="description" content="gori">
-  <meta name="author" content="anders pearson">
-    <link href="/media/bootstrap/css/bootstrap.css" rel="stylesheet">
-    <link href="/media/bootstrap/css/bootstrap-responsive.css" rel="stylesheet">
-    <link href="/media/css/main.css" rel="stylesheet">
-    <link type="text/css" rel="stylesheet" href="/media/main.css" />
- <script src="/media/js/jquery-1.7.2.min.js"></script>
-<script src="http://html5shim.googlecode.com/svn/trunk/html5.js"></script>
-</head>
-<body>
-<div class="navbar navbar-fixed-top navbar-inverse">
-    <div class="navbar-inner">
-      <div class="container">
-        <ul class="nav">
-          <li><a class="brand" href="/"><i class="icon-home icon-white"></i></a></li>
-        </ul>
-      </div>
-    </div>
-</div>
-<div class="container" id="outer-container">
-<p class="muted pull-right">Last Modified: <b>{{.Modified}}</b></p>
-<h1>{{.Title}} <small><a href="/edit/{{.Slug}}/"><i class="icon-edit"></i></a></small></h1>
-{{.Body}}
-</div>
-<script type="text/javascript" src="http://platform.twitter.com/widgets.js"></script>
-<script src="/media/bootstrap/js/bootstrap.js"></script>
-</body>
-</html>
-`
+		Title:       page.Title,
+		Slug:        slug,
+		Body:        body,
+		Modified:    page.RenderModified(),
+		Protected:   page.Protected,
+		IncludedBy:  ctx.Index.IncludedBy(slug),
+		Tags:        page.AllTags(),
+		Crumbs:      breadcrumbs(slug, ctx.Index),
+		Subpages:    ctx.Index.Subpages(slug),
+		Attachments: page.Attachments,
+	}
+	if page.Meta.TOC == "sidebar" {
+		pr.TOC = template.HTML(renderTOC(extractTOC([]byte(body))))
+	}
+	ctx.Templates.Render(w, "view.html", pr)
+}
 
 type EditPageResponse struct {
-	Title    string
-	Slug     string
-	Existing bool
-	Body     template.HTML
+	Title       string
+	Slug        string
+	Existing    bool
+	Body        template.HTML
+	Protected   bool
+	IsAdmin     bool
+	CSRFToken   string
+	Templates   []Page
+	Template    string
+	Tags        string
+	Attachments []Attachment
+	Draft       *Draft
+	// the page was saved by someone after the draft was
+	DraftStale bool
+	// editing just one section of the page, or -1 for all of it
+	Section      int
+	SectionTitle string
+	Sections     []Section
+	// the version of the page the form started from, for merging with
+	// anything saved in the meantime
+	Version int
+	// the merge didn't go cleanly, so Body has conflict markers in it
+	Conflict bool
 }
 
+// deslug makes a title out of the last part of a slug
 func deslug(s string) string {
+	s = s[strings.LastIndex(s, "/")+1:]
 	s = strings.Replace(s, "-", " ", -1)
 	s = strings.Title(s)
 	return s
 }
 
-func editHandler(w http.ResponseWriter, r *http.Request, ctx Context) {
-	parts := strings.Split(r.URL.String(), "/")
-	if len(parts) < 3 {
-		http.Error(w, "bad request", 400)
-		return
-	}
-	slug := parts[2]
-	if slug == "" {
-		http.Error(w, "bad request", 400)
-		return
-	}
+func editHandler(w http.ResponseWriter, r *http.Request, ctx Context, params Params) {
+	slug := params.Slug
 	page, err := ctx.PageReadRepo.FindBySlug(slug)
 	if err != nil {
 		log.Println(err)
-		http.Error(w, "error retrieving page", 500)
+		errorPage(w, ctx, http.StatusServiceUnavailable, unavailableMessage)
+		return
+	}
+	if page.RedirectTo != "" {
+		// the page has moved, edit it where it is now
+		http.Redirect(w, r, "/edit/"+page.RedirectTo+"/", http.StatusMovedPermanently)
 		return
 	}
 
+	isAdmin := ctx.Auth.IsAdmin(r)
+	section := -1
+	if s := r.FormValue("section"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			errorPage(w, ctx, 400, "bad section number")
+			return
+		}
+		section = n
+	}
+
 	if r.Method == "POST" {
-		page.Slug = slug
-		ctx.PageWriteRepo.SetTitle(page, r.FormValue("title"))
-		ctx.PageWriteRepo.SetBody(page, r.FormValue("body"))
+		if !ctx.CSRF.Verify(r) {
+			errorPage(w, ctx, 403, csrfFailedMessage)
+			return
+		}
+		if page.Protected && !isAdmin {
+			errorPage(w, ctx, 403, "this page is protected and can only be edited by an admin")
+			return
+		}
+		base, err := baseVersion(r, ctx, slug, page)
+		if err != nil {
+			log.Println(err)
+			errorPage(w, ctx, http.StatusServiceUnavailable, unavailableMessage)
+			return
+		}
+		// saving changes page as it goes, so keep base as it is now
+		original := *base
+		base = &original
+		body := r.FormValue("body")
+		if section >= 0 {
+			// put the section back into the page it was taken from
+			var ok bool
+			body, ok = replaceSection(base.Body, section, body)
+			if !ok {
+				errorPage(w, ctx, http.StatusConflict, "that section isn't there any more. someone else may have changed the page")
+				return
+			}
+		}
+		for attempt := 1; ; attempt++ {
+			title := r.FormValue("title")
+			tags := splitList(r.FormValue("tags"))
+			body := body
+			if page.Version != base.Version {
+				// someone else saved the page while this was being edited.
+				// keep their changes to anything this edit didn't touch
+				if title == base.Title {
+					title = page.Title
+				}
+				if strings.Join(normalizeTags(tags), ",") == strings.Join(base.Tags, ",") {
+					tags = page.Tags
+				}
+				if base.Body != page.Body {
+					merged, clean := merge3(base.Body, page.Body, body)
+					if !clean {
+						ctx.Templates.RenderStatus(w, http.StatusConflict, "edit.html", EditPageResponse{
+							Title:       title,
+							Slug:        slug,
+							Existing:    page.Title != "",
+							Body:        template.HTML(merged),
+							Protected:   page.Protected,
+							IsAdmin:     isAdmin,
+							CSRFToken:   ctx.CSRF.Token(w, r),
+							Tags:        strings.Join(tags, ", "),
+							Attachments: page.Attachments,
+							Section:     -1,
+							Sections:    page.Sections(),
+							Version:     page.Version,
+							Conflict:    true,
+						})
+						return
+					}
+					body = merged
+				}
+			}
+			page.Slug = slug
+			err = ctx.PageWriteRepo.Save(page, title, body, tags)
+			if err != errVersionConflict || attempt == maxSaveAttempts {
+				break
+			}
+			// someone else saved it between reading it here and saving
+			// it, so merge with what they saved and try again
+			page, err = ctx.PageReadRepo.FindBySlug(slug)
+			if err != nil {
+				break
+			}
+		}
+		if err == errVersionConflict {
+			errorPage(w, ctx, http.StatusConflict, "lots of other people are saving this page right now. try again in a minute")
+			return
+		}
+		if err != nil {
+			// the draft is kept, so what they typed isn't lost
+			log.Println(err)
+			errorPage(w, ctx, http.StatusServiceUnavailable, unavailableMessage)
+			return
+		}
+		// drafts are of the whole page, so a section edit leaves them alone
+		if owner := draftOwner(r, ctx); owner != "" && section < 0 {
+			if err := ctx.Drafts.Discard(owner, slug); err != nil {
+				log.Println(err)
+			}
+		}
 		http.Redirect(w, r, "/page/"+slug+"/", http.StatusFound)
 	} else {
 		// just show the edit form
-		w.Header().Set("Content-Type", "text/html")
+		token := ctx.CSRF.Token(w, r)
 		title := page.Title
-		var existing = false
+		body := page.Body
+		tags := strings.Join(page.Tags, ", ")
+		version := page.Version
+		var existing = page.Title != ""
+		var templates []Page
+		chosen := ""
 		if page.Title == "" {
 			title = deslug(slug)
 			existing = false
+			// new page, so it can start out from a template
+			templates = ctx.Index.Templates()
+			chosen = r.FormValue("template")
+			if isTemplateSlug(chosen) {
+				tmpl, err := ctx.PageReadRepo.FindBySlug(chosen)
+				if err != nil {
+					log.Println(err)
+				}
+				if err == nil && tmpl.Title != "" {
+					vars := templateVars(title, slug, ctx.Auth.User(r), time.Now())
+					body = applyTemplate(tmpl.Body, vars)
+				}
+			}
+		}
+		sectionTitle := ""
+		if section >= 0 {
+			text, ok := getSection(page.Body, section)
+			if !existing || !ok {
+				errorPage(w, ctx, 404, "no such section")
+				return
+			}
+			body = text
+			if section > 0 {
+				sectionTitle = page.Sections()[section-1].Title
+			}
+		}
+		// pick up where they left off if there's an unsaved draft
+		var draft *Draft
+		stale := false
+		if owner := draftOwner(r, ctx); owner != "" && section < 0 {
+			draft, err = ctx.Drafts.Get(owner, slug)
+			if err != nil {
+				log.Println(err)
+			}
+			if draft != nil {
+				title, body, tags = draft.Title, draft.Body, draft.Tags
+				version = draft.Version
+				stale = existing && page.Version > draft.Version
+			}
+		}
+		ctx.Templates.Render(w, "edit.html", EditPageResponse{
+			Title:        title,
+			Slug:         slug,
+			Existing:     existing,
+			Body:         template.HTML(body),
+			Protected:    page.Protected,
+			IsAdmin:      isAdmin,
+			CSRFToken:    token,
+			Templates:    templates,
+			Template:     chosen,
+			Tags:         tags,
+			Attachments:  page.Attachments,
+			Draft:        draft,
+			DraftStale:   stale,
+			Section:      section,
+			SectionTitle: sectionTitle,
+			Sections:     page.Sections(),
+			Version:      version,
+		})
+	}
+}
+
+// baseVersion is the page as it was when the edit form was loaded,
+// going by the version posted with it. that's just the current page if
+// nobody has saved it since (or the form didn't say).
+func baseVersion(r *http.Request, ctx Context, slug string, page *Page) (*Page, error) {
+	version, err := strconv.Atoi(r.FormValue("version"))
+	if err != nil || version < 0 || version >= page.Version {
+		return page, nil
+	}
+	events, err := ctx.EventStore.GetEventsFor(slug)
+	if err != nil {
+		return nil, err
+	}
+	if version > len(events) {
+		return page, nil
+	}
+	return events[:version].Apply(), nil
+}
+
+// draftOwner is who drafts get saved for: the logged in user, or if
+// there isn't one, the browser session
+func draftOwner(r *http.Request, ctx Context) string {
+	if user := ctx.Auth.User(r); user != "" {
+		return user
+	}
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return ""
+	}
+	return "session:" + cookie.Value
+}
+
+// draftHandler saves the edit form as a draft, which the form does in
+// the background every so often. posting discard=true throws the draft
+// away instead and goes back to the edit form.
+func draftHandler(w http.ResponseWriter, r *http.Request, ctx Context, params Params) {
+	slug := params.Slug
+	if !ctx.CSRF.Verify(r) {
+		errorPage(w, ctx, 403, csrfFailedMessage)
+		return
+	}
+	owner := draftOwner(r, ctx)
+	if owner == "" {
+		errorPage(w, ctx, 400, "no session to save the draft for")
+		return
+	}
+	if r.FormValue("discard") == "true" {
+		if err := ctx.Drafts.Discard(owner, slug); err != nil {
+			log.Println(err)
+			errorPage(w, ctx, 500, "error discarding draft")
+			return
 		}
-		t, _ := template.New("edit").Parse(page_edit_template)
-		t.Execute(w, EditPageResponse{
-			Title:    title,
-			Slug:     slugify(page.Title),
-			Existing: existing,
-			Body:     template.HTML(page.Body),
+		http.Redirect(w, r, "/edit/"+slug+"/", http.StatusSeeOther)
+		return
+	}
+	version, _ := strconv.Atoi(r.FormValue("version"))
+	err := ctx.Drafts.Save(Draft{
+		Owner:   owner,
+		Slug:    slug,
+		Title:   r.FormValue("title"),
+		Body:    r.FormValue("body"),
+		Tags:    r.FormValue("tags"),
+		Version: version,
+		Saved:   time.Now(),
+	})
+	if err != nil {
+		log.Println(err)
+		errorPage(w, ctx, 500, "error saving draft")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// previewHandler renders a posted body the same way the page would be
+// shown, without saving anything. the edit form's preview tab uses it.
+func previewHandler(w http.ResponseWriter, r *http.Request, ctx Context, params Params) {
+	slug := params.Slug
+	if !ctx.CSRF.Verify(r) {
+		errorPage(w, ctx, 403, csrfFailedMessage)
+		return
+	}
+	// a copy of the page as it would be with this body, so links and
+	// attachments resolve relative to where it's going to live
+	page := &Page{Slug: slug, Title: r.FormValue("title")}
+	page.SetBody(r.FormValue("body"))
+	body := ctx.Transcluder.Render(page)
+	if page.Meta.TOC == "sidebar" {
+		body = template.HTML(renderTOC(extractTOC([]byte(body)))) + body
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(body))
+}
+
+type HistoryEntry struct {
+	Command   string
+	User      string
+	Created   string
+	Protected bool
+}
+
+type HistoryResponse struct {
+	Title     string
+	Slug      string
+	Protected bool
+	Entries   []HistoryEntry
+}
+
+func historyHandler(w http.ResponseWriter, r *http.Request, ctx Context, params Params) {
+	slug := params.Slug
+	events, err := ctx.EventStore.GetEventsFor(slug)
+	if err != nil {
+		log.Println(err)
+		errorPage(w, ctx, http.StatusServiceUnavailable, unavailableMessage)
+		return
+	}
+	if len(events) == 0 {
+		errorPage(w, ctx, 404, "page not found")
+		return
+	}
+	// replay the events one at a time so each entry can show
+	// what the lock state was after it was applied
+	p := &Page{}
+	entries := make([]HistoryEntry, 0, len(events))
+	for _, event := range events {
+		p = event.Apply(p)
+		entries = append(entries, HistoryEntry{
+			Command:   event.GetCommand(),
+			User:      event.GetContext(),
+			Created:   event.GetCreated().Format(time.RFC3339),
+			Protected: p.Protected,
 		})
 	}
+	ctx.Templates.Render(w, "history.html", HistoryResponse{
+		Title:     p.Title,
+		Slug:      slug,
+		Protected: p.Protected,
+		Entries:   entries,
+	})
 }
 
-const page_edit_template = `
-<!DOCTYPE html>
-<html lang="en">
-<head>
-<meta charset="utf-8" />
-<title>Edit {{.Title}}</title>
- <meta name="viewport" content="width=device-width, initial-scale=1.0">
-  <meta name="description" content="gori">
-  <meta name="author" content="anders pearson">
-    <link href="/media/bootstrap/css/bootstrap.css" rel="stylesheet">
-    <link href="/media/bootstrap/css/bootstrap-responsive.css" rel="stylesheet">
-    <link href="/media/css/main.css" rel="stylesheet">
-    <link type="text/css" rel="stylesheet" href="/media/main.css" />
- <script src="/media/js/jquery-1.7.2.min.js"></script>
-<script src="http://html5shim.googlecode.com/svn/trunk/html5.js"></script>
-</head>
-<body>
-<div class="navbar navbar-fixed-top navbar-inverse">
-    <div class="navbar-inner">
-      <div class="container">
-        <ul class="nav">
-          <li><a class="brand" href="/"><i class="icon-home icon-white"></i></a></li>
-        </ul>
-      </div>
-    </div>
-</div>
-<div class="container" id="outer-container">
-
-<form action="." method="post">
-<fieldset>
-<legend>Edit {{.Title}}</legend>
-<input type="text" name="title" value="{{.Title}}" placeholder="title" class="input-block-level"/>
-<textarea name="body" rows="30" class="input-block-level">{{.Body}}</textarea>
-{{ if .Existing }}
-<a class="btn" href="/edit/{{.Slug}}/">cancel</a>
-{{ else }}
-<input type="hidden" name="create" value="true" />
-<a class="btn" href="/page/index/">cancel</a>
-{{ end }}
-<input class="btn btn-primary" type="submit" value="save">
-</form>
-</div>
-<script type="text/javascript" src="http://platform.twitter.com/widgets.js"></script>
-<script src="/media/bootstrap/js/bootstrap.js"></script>
-</body>
-</html>
-`
+func protectHandler(w http.ResponseWriter, r *http.Request, ctx Context, params Params) {
+	setProtection(w, r, ctx, params.Slug, true)
+}
+
+func unprotectHandler(w http.ResponseWriter, r *http.Request, ctx Context, params Params) {
+	setProtection(w, r, ctx, params.Slug, false)
+}
+
+func setProtection(w http.ResponseWriter, r *http.Request, ctx Context, slug string, protected bool) {
+	if !ctx.CSRF.Verify(r) {
+		errorPage(w, ctx, 403, csrfFailedMessage)
+		return
+	}
+	if !ctx.Auth.IsAdmin(r) {
+		errorPage(w, ctx, 403, "only admins can change page protection")
+		return
+	}
+	page, err := ctx.PageReadRepo.FindBySlug(slug)
+	if err != nil {
+		log.Println(err)
+		errorPage(w, ctx, http.StatusServiceUnavailable, unavailableMessage)
+		return
+	}
+	if page.Title == "" {
+		errorPage(w, ctx, 404, "page not found")
+		return
+	}
+	page.Slug = slug
+	user := ctx.Auth.User(r)
+	if protected {
+		err = ctx.PageWriteRepo.Protect(page, user)
+	} else {
+		err = ctx.PageWriteRepo.Unprotect(page, user)
+	}
+	if err != nil {
+		log.Println(err)
+		errorPage(w, ctx, 500, "error saving page")
+		return
+	}
+	http.Redirect(w, r, "/page/"+slug+"/", http.StatusFound)
+}
+
+type PageListResponse struct {
+	Heading string
+	Query   string
+	Pages   []Page
+}
+
+// listHandler shows all the pages, optionally narrowed down by a text
+// search (q), tag, author or any custom front matter field, eg:
+// /pages/?q=postgres&tag=ops&team=infra
+func listHandler(w http.ResponseWriter, r *http.Request, ctx Context, params Params) {
+	query := r.URL.Query()
+	filter := PageFilter{
+		Query:  query.Get("q"),
+		Tag:    query.Get("tag"),
+		Author: query.Get("author"),
+		Fields: make(map[string]string),
+	}
+	for key := range query {
+		switch key {
+		case "q", "tag", "author":
+		default:
+			filter.Fields[key] = query.Get(key)
+		}
+	}
+	ctx.Templates.Render(w, "list.html", PageListResponse{
+		Heading: "Pages",
+		Query:   filter.Query,
+		Pages:   ctx.Index.Find(filter),
+	})
+}
+
+func tagHandler(w http.ResponseWriter, r *http.Request, ctx Context, params Params) {
+	tag := strings.ToLower(params.Slug)
+	ctx.Templates.Render(w, "list.html", PageListResponse{
+		Heading: "Pages tagged " + tag,
+		Pages:   ctx.Index.Find(PageFilter{Tag: tag}),
+	})
+}
+
+type TagCloudEntry struct {
+	Tag   string
+	Count int
+	Size  int
+}
+
+// tagsHandler shows every tag, sized by how many pages use it
+func tagsHandler(w http.ResponseWriter, r *http.Request, ctx Context, params Params) {
+	counts := ctx.Index.TagCounts()
+	max := 1
+	for _, c := range counts {
+		if c.Count > max {
+			max = c.Count
+		}
+	}
+	entries := make([]TagCloudEntry, 0, len(counts))
+	for _, c := range counts {
+		entries = append(entries, TagCloudEntry{
+			Tag:   c.Tag,
+			Count: c.Count,
+			// 1 through 5
+			Size: 1 + (c.Count*4)/max,
+		})
+	}
+	ctx.Templates.Render(w, "tags.html", entries)
+}
+
+// attachmentName cleans up an uploaded file's name so it can't be used
+// to get at other paths
+func attachmentName(name string) string {
+	name = strings.Replace(name, "\\", "/", -1)
+	name = strings.TrimSpace(path.Base(name))
+	if name == "." || name == "/" || name == ".." {
+		return ""
+	}
+	return name
+}
+
+func attachHandler(w http.ResponseWriter, r *http.Request, ctx Context, params Params) {
+	slug := params.Slug
+	// the upload form puts the token in the query string, so a forged
+	// upload is turned away before any of it gets written to disk
+	if !ctx.CSRF.VerifyToken(r, r.URL.Query().Get(csrfFieldName)) {
+		errorPage(w, ctx, 403, csrfFailedMessage)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, ctx.MaxUploadSize)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		log.Println(err)
+		errorPage(w, ctx, 400, "upload is too large or not a proper file upload")
+		return
+	}
+	page, err := ctx.PageReadRepo.FindBySlug(slug)
+	if err != nil {
+		log.Println(err)
+		errorPage(w, ctx, http.StatusServiceUnavailable, unavailableMessage)
+		return
+	}
+	if !page.Exists() {
+		errorPage(w, ctx, 404, "save the page before attaching files to it")
+		return
+	}
+	if page.Protected && !ctx.Auth.IsAdmin(r) {
+		errorPage(w, ctx, 403, "this page is protected and can only be edited by an admin")
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		errorPage(w, ctx, 400, "no file uploaded")
+		return
+	}
+	defer file.Close()
+	name := attachmentName(header.Filename)
+	if name == "" {
+		errorPage(w, ctx, 400, "bad file name")
+		return
+	}
+	hash, size, err := ctx.Blobs.Put(file)
+	if err != nil {
+		log.Println(err)
+		errorPage(w, ctx, 500, "error storing file")
+		return
+	}
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	page.Slug = slug
+	err = ctx.PageWriteRepo.Attach(page, Attachment{
+		Name:        name,
+		Hash:        hash,
+		ContentType: contentType,
+		Size:        size,
+		Created:     time.Now(),
+	}, ctx.Auth.User(r))
+	if err != nil {
+		log.Println(err)
+		errorPage(w, ctx, 500, "error saving page")
+		return
+	}
+	http.Redirect(w, r, "/edit/"+slug+"/", http.StatusFound)
+}
+
+// attachmentHandler serves /attachments/<slug>/<name>
+func attachmentHandler(w http.ResponseWriter, r *http.Request, ctx Context, params Params) {
+	slug, name := ctx.Index.Canonical(params.Slug), params.Name
+	page, err := ctx.PageReadRepo.FindBySlug(slug)
+	if err != nil {
+		log.Println(err)
+		errorPage(w, ctx, http.StatusServiceUnavailable, unavailableMessage)
+		return
+	}
+	a, ok := page.Attachment(name)
+	if !ok {
+		errorPage(w, ctx, 404, "attachment not found")
+		return
+	}
+	var blob io.ReadSeekCloser
+	width, _ := strconv.Atoi(r.FormValue("w"))
+	height, _ := strconv.Atoi(r.FormValue("h"))
+	if a.IsImage() && (width > 0 || height > 0) {
+		thumbnail, err := ctx.Thumbnails.Thumbnail(a, width, height)
+		if err == nil {
+			blob, err = os.Open(thumbnail)
+		}
+		if err != nil && err != errNotThumbnailable {
+			log.Println(err)
+			errorPage(w, ctx, 400, "couldn't make a thumbnail")
+			return
+		}
+	}
+	if blob == nil {
+		blob, err = ctx.Blobs.Open(a.Hash)
+		if err != nil {
+			log.Println(err)
+			errorPage(w, ctx, 404, "attachment not found")
+			return
+		}
+	}
+	defer blob.Close()
+	w.Header().Set("Content-Type", a.ContentType)
+	// uploads are whatever people uploaded. don't let the browser guess
+	// at them or run anything in them if they're opened directly
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+	if !a.IsImage() {
+		w.Header().Set("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(a.Name))
+	}
+	http.ServeContent(w, r, a.Name, a.Created, blob)
+}